@@ -0,0 +1,169 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// where CI publishes extension tarballs for --from-artifacts; {extension} is replaced with the extension
+// name, and the sha256 of each tarball must be published next to it with .sha256 on the end. Set from the
+// settings file
+var ARTIFACTURL string
+
+// written into an extension deployed from an artifact, recording the sha256 of the tarball it came from;
+// it's a dotfile so it's never synced
+const ARTIFACTCHECKSUMFILE = ".artifact-sha256"
+
+// how long downloading a single tarball may take
+const ARTIFACTTIMEOUT = 10 * time.Minute
+
+// whether an extension in staging came from an artifact rather than git
+func isArtifact(path string) bool {
+	_, err := os.Stat(path + "/" + ARTIFACTCHECKSUMFILE)
+	return err == nil
+}
+
+// the version of a repo in staging which deployed markers record; the sha it's checked out at, or for an
+// extension which came from an artifact, the checksum of the artifact
+func stagingVersion(repoPath string) (string, error) {
+	if checksum, err := os.ReadFile(repoPath + "/" + ARTIFACTCHECKSUMFILE); err == nil {
+		return "sha256:" + strings.TrimSpace(string(checksum)), nil
+	}
+
+	return gitOutput(repoPath, "rev-parse", "HEAD")
+}
+
+// replace an extension in staging with its tarball from CI, once its checksum has been verified; the
+// extension is swapped in whole, so anything in staging which isn't in the tarball (including a git
+// checkout) is gone afterwards
+func updateExtensionFromArtifact(extension string, config *DeployConfig) error {
+	url := strings.ReplaceAll(config.ArtifactURL, "{extension}", extension)
+	extPath := fmt.Sprintf("%s/%s", EXTENSIONPATH, extension)
+
+	if DRYRUN {
+		logf("Would download %s and replace %s with it\n", url, extPath)
+		return nil
+	}
+
+	want, err := fetchArtifactChecksum(url + ".sha256")
+	if err != nil {
+		return err
+	}
+
+	// next to the extension, so the new tree can be renamed into place; a dotfile so nothing else picks it up
+	tmp, err := os.MkdirTemp(EXTENSIONPATH, "."+extension+".artifact-")
+	if err != nil {
+		return fmt.Errorf("failed to create a directory to unpack %s in: %w", url, err)
+	}
+	defer os.RemoveAll(tmp)
+
+	got, err := downloadArtifact(url, tmp+"/artifact.tar")
+	if err != nil {
+		return err
+	}
+	if got != want {
+		return fmt.Errorf("checksum of %s doesn't match, expected %s but got %s", url, want, got)
+	}
+
+	tree := tmp + "/tree"
+	if err := os.Mkdir(tree, 0755); err != nil {
+		return err
+	}
+	if err := runCommand("tar", "-xf", tmp+"/artifact.tar", "-C", tree); err != nil {
+		return fmt.Errorf("failed to unpack %s: %w", url, err)
+	}
+
+	// tarballs usually have everything under a single directory named after the extension
+	entries, err := os.ReadDir(tree)
+	if err != nil {
+		return err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		tree += "/" + entries[0].Name()
+	}
+
+	if err := os.WriteFile(tree+"/"+ARTIFACTCHECKSUMFILE, []byte(got+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to record the checksum of %s: %w", url, err)
+	}
+
+	if !isArtifact(extPath) {
+		if _, err := os.Stat(extPath + "/.git"); err == nil {
+			logf("Replacing the git checkout of %s with its artifact\n", extension)
+		}
+	}
+
+	// move the old tree out of the way rather than deleting it first, so it can be put back if the swap fails
+	if err := os.Rename(extPath, tmp+"/old"); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to move %s aside: %w", extPath, err)
+	}
+	if err := os.Rename(tree, extPath); err != nil {
+		os.Rename(tmp+"/old", extPath)
+		return fmt.Errorf("failed to move the unpacked %s into place: %w", url, err)
+	}
+
+	logf("Unpacked %s (sha256 %s)\n", url, got)
+	return nil
+}
+
+// fetch the published sha256 of an artifact, which is the first word of the file like sha256sum writes
+func fetchArtifactChecksum(url string) (string, error) {
+	client := &http.Client{Timeout: HTTPTIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch checksum %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to fetch checksum %s: %s", url, resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err != nil {
+		return "", fmt.Errorf("failed to fetch checksum %s: %w", url, err)
+	}
+
+	fields := strings.Fields(string(body))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksum %s is empty", url)
+	}
+	if _, err := hex.DecodeString(fields[0]); err != nil || len(fields[0]) != sha256.Size*2 {
+		return "", fmt.Errorf("checksum %s doesn't contain a sha256", url)
+	}
+
+	return strings.ToLower(fields[0]), nil
+}
+
+// download an artifact to a file, returning the sha256 of what was downloaded
+func downloadArtifact(url string, path string) (string, error) {
+	client := &http.Client{Timeout: ARTIFACTTIMEOUT}
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	file, err := os.Create(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(file, hash), resp.Body); err != nil {
+		return "", fmt.Errorf("failed to download %s: %w", url, err)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,173 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// where snapshots of production are kept for --backup; outside of production so that --config doesn't sync them
+var BACKUPPATH = "/prod/mediawiki-backups"
+
+// how backups are named, so they sort by when they were taken
+const BACKUPTIMEFORMAT = "20060102-150405"
+
+// files which are rewritten in place rather than replaced, so have to be copied into a backup rather
+// than hard linked, otherwise rewriting them would change the backup too
+var BACKUPCOPIEDFILES = []string{"config/ExtensionMessageFiles.php"}
+
+// how a snapshot of production (a backup or a release) is copied: hard linked, since rsync replaces changed
+// files with new ones rather than writing to them, so the snapshot keeps the old contents while only taking
+// up space for what changed. --chmod is the exception, rsync changes the permissions of the existing file,
+// which a hard linked snapshot shares, so then it's a full copy
+func snapshotCopyFlags(config *DeployConfig) string {
+	if config.Chmod != "" {
+		return "-a"
+	}
+	return "-al"
+}
+
+// take a snapshot of production before a deploy changes it
+func createBackup(config *DeployConfig) (string, error) {
+	backupPath := fmt.Sprintf("%s/%s", BACKUPPATH, time.Now().Format(BACKUPTIMEFORMAT))
+
+	if !DRYRUN {
+		if err := os.MkdirAll(BACKUPPATH, 0755); err != nil {
+			return "", fmt.Errorf("failed to create backup directory: %w", err)
+		}
+	}
+
+	if err := runCommand("cp", snapshotCopyFlags(config), PRODUCTIONPATH, backupPath); err != nil {
+		return "", fmt.Errorf("failed to back up %s: %w", PRODUCTIONPATH, err)
+	}
+
+	if DRYRUN {
+		return backupPath, nil
+	}
+
+	for _, file := range BACKUPCOPIEDFILES {
+		if err := unlinkCopy(backupPath + "/" + file); err != nil {
+			return "", fmt.Errorf("failed to back up %s: %w", file, err)
+		}
+	}
+
+	return backupPath, nil
+}
+
+// replace a hard link with a copy of the file it links to, so the two can change independently
+func unlinkCopy(path string) error {
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, info.Mode())
+}
+
+// list the backups which can be rolled back to, oldest first
+func listBackups() ([]string, error) {
+	entries, err := os.ReadDir(BACKUPPATH)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var backups []string
+	for _, entry := range entries {
+		if _, err := time.Parse(BACKUPTIMEFORMAT, entry.Name()); entry.IsDir() && err == nil {
+			backups = append(backups, entry.Name())
+		}
+	}
+	sort.Strings(backups)
+
+	return backups, nil
+}
+
+// remove the oldest backups until only keep are left; each one only takes up space for what the deploy
+// after it changed, but that adds up over every deploy
+func pruneBackups(keep int) error {
+	backups, err := listBackups()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range backups[:max(len(backups)-keep, 0)] {
+		path := fmt.Sprintf("%s/%s", BACKUPPATH, name)
+		logf("Removing old backup %s\n", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove backup %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// roll local production back to a backup taken by deploy --backup, or list the backups if none is given
+func runRollback(args []string) {
+	rollbackCmd := flag.NewFlagSet("rollback", flag.ExitOnError)
+	rollbackCmd.Parse(args)
+
+	if rollbackCmd.NArg() == 0 {
+		backups, err := listBackups()
+		if err != nil {
+			ExitWithError(fmt.Errorf("failed to list backups: %w", err), 1)
+		}
+
+		if JSONOUTPUT {
+			printJSON(map[string]any{"backups": backups})
+			return
+		}
+
+		if len(backups) == 0 {
+			fmt.Printf("No backups in %s\n", BACKUPPATH)
+			return
+		}
+
+		fmt.Println("Backups available to roll back to:")
+		for _, backup := range backups {
+			fmt.Printf("  %s\n", backup)
+		}
+		return
+	}
+
+	timestamp := rollbackCmd.Arg(0)
+	if _, err := time.Parse(BACKUPTIMEFORMAT, timestamp); err != nil {
+		ExitWithError(fmt.Errorf("invalid backup %s, expected a timestamp like %s", timestamp, BACKUPTIMEFORMAT), 1)
+	}
+
+	backupPath := fmt.Sprintf("%s/%s", BACKUPPATH, timestamp)
+	if _, err := os.Stat(backupPath); err != nil {
+		ExitWithError(fmt.Errorf("no such backup: %w", err), 1)
+	}
+
+	logf("Rolling %s back to %s\n", PRODUCTIONPATH, backupPath)
+
+	// unlike a deploy this has to put back older files too, so rsync can't skip anything just for being newer
+	if err := runCommand("rsync", "-a", "--delete", backupPath+"/", PRODUCTIONPATH+"/"); err != nil {
+		ExitWithError(fmt.Errorf("failed to roll back: %w", err), 1)
+	}
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"rolled_back_to": timestamp})
+		return
+	}
+
+	fmt.Printf("Rolled back to %s; this only changed this server, use deploy --push-only <server> --config to roll back the others\n", timestamp)
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// whether a repo has anything new to deploy: commits on its upstream (as of the last fetch) which aren't
+// in since, or if since is empty, which the pull hasn't brought in yet; along with why, when it can't tell
+// and so counts it as changed
+func repoChangedSince(repoPath string, since string) (bool, string, error) {
+	target, err := gitOutput(repoPath, "rev-parse", "--verify", "--quiet", "@{upstream}")
+	if err != nil || target == "" {
+		return true, "it has no upstream to compare with", nil
+	}
+
+	base := "HEAD"
+	if since != "" {
+		// e.g. a release tag which was only ever made in some repos
+		if _, err := gitOutput(repoPath, "rev-parse", "--verify", "--quiet", since+"^{commit}"); err != nil {
+			return true, fmt.Sprintf("it doesn't have %s", since), nil
+		}
+		base = since
+	}
+
+	count, err := gitOutput(repoPath, "rev-list", "--count", base+".."+target)
+	if err != nil {
+		return false, "", err
+	}
+
+	n, err := strconv.Atoi(count)
+	if err != nil {
+		return false, "", fmt.Errorf("unexpected output from git rev-list in %s: %s", repoPath, count)
+	}
+
+	return n > 0, "", nil
+}
+
+// drop the extensions or skins with nothing new to deploy from a list, recording the ones dropped; any which
+// can't be compared are kept, since deploying something unchanged is harmless and skipping a change isn't
+func filterChanged(names []string, path string, kind string, config *DeployConfig) ([]string, error) {
+	var changed []string
+	for _, name := range names {
+		ok, why, err := repoChangedSince(path+"/"+name, config.SinceCommit)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s %s for changes: %w", kind, name, err)
+		}
+
+		if why != "" {
+			logf("Including %s %s with --only-changed-repos, since %s\n", kind, name, why)
+		}
+
+		if ok {
+			changed = append(changed, name)
+		} else {
+			config.unchanged[kind+":"+name] = true
+		}
+	}
+
+	return changed, nil
+}
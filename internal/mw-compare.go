@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// print, for each extension and skin about to be upgraded, the commits between the sha its deployed marker
+// in production records and what it's being deployed at; with a lock that's the locked sha, otherwise the
+// ref given to --compare-ref as it is in staging
+func printDeployedComparison(config *DeployConfig) {
+	compare := func(kind string, name string, stagingPath string, prodPath string, locked string) {
+		target := config.CompareRef
+		if config.Lock != nil {
+			target = locked
+		}
+
+		logf("%s %s:\n", kind, name)
+
+		marker, err := readDeployedMarker(prodPath)
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			logf("  no %s in %s, can't tell what's deployed\n", DEPLOYEDMARKER, prodPath)
+			return
+		case err != nil:
+			logf("  %v\n", err)
+			return
+		case strings.HasPrefix(marker.SHA, "sha256:") || isArtifact(stagingPath):
+			logf("  deployed from an artifact, there's no git history to compare\n")
+			return
+		}
+
+		commits, err := gitOutput(stagingPath, "log", "--oneline", marker.SHA+".."+target)
+		if err != nil {
+			logf("  failed to compare deployed %s with %s: %v\n", marker.SHA, target, err)
+			return
+		}
+
+		if commits == "" {
+			logf("  nothing new, %s is already deployed\n", target)
+			return
+		}
+
+		for _, commit := range strings.Split(commits, "\n") {
+			logf("  %s\n", commit)
+		}
+	}
+
+	if config.Lock != nil {
+		logf("Changes between what's deployed and the locked shas:\n")
+	} else {
+		logf("Changes between what's deployed and %s:\n", config.CompareRef)
+	}
+	for _, ext := range config.UpgradeExtensions {
+		compare("extension", ext, fmt.Sprintf("%s/%s", EXTENSIONPATH, ext), fmt.Sprintf("%s/%s/%s", PRODUCTIONPATH, config.ProdExtensionsDir, ext), lockedSHA(config.Lock, ext, false))
+	}
+	for _, skin := range config.UpgradeSkins {
+		compare("skin", skin, fmt.Sprintf("%s/%s", SKINPATH, skin), fmt.Sprintf("%s/%s/%s", PRODUCTIONPATH, config.ProdSkinsDir, skin), lockedSHA(config.Lock, skin, true))
+	}
+}
+
+// the sha an extension or skin is locked at, if there's a lock
+func lockedSHA(lock *deployLock, name string, isSkin bool) string {
+	switch {
+	case lock == nil:
+		return ""
+	case isSkin:
+		return lock.Skins[name]
+	}
+	return lock.Extensions[name]
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// the outcome of installing one extension's composer dependencies
+type composerResult struct {
+	Extension string
+	Err       error
+	Duration  time.Duration
+}
+
+// whether an extension in staging manages its own dependencies with composer
+func hasComposerJSON(extension string) bool {
+	_, err := os.Stat(fmt.Sprintf("%s/%s/composer.json", EXTENSIONPATH, extension))
+	return err == nil
+}
+
+// run composer install in each of the extensions, up to parallel at once; every extension has its own
+// directory, but composer's cache is shared, so each worker gets a cache of its own to avoid two installs
+// writing the same cache entry at once
+func installExtensionDependencies(extensions []string, parallel int) []composerResult {
+	results := make([]composerResult, len(extensions))
+
+	// worker ids rather than empty tokens, so each worker knows which cache is its own
+	workers := make(chan int, max(parallel, 1))
+	for i := range max(parallel, 1) {
+		workers <- i
+	}
+
+	var wg sync.WaitGroup
+	for i, ext := range extensions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			worker := <-workers
+			defer func() { workers <- worker }()
+
+			out := newTaggedOutput(ext)
+			defer out.Flush()
+
+			started := time.Now()
+			err := composerInstall(out, ext, fmt.Sprintf("%s/.composer-cache/%d", STAGINGPATH, worker))
+			results[i] = composerResult{Extension: ext, Err: err, Duration: time.Since(started)}
+
+			if err == nil && !DRYRUN {
+				out.logf("composer install took %s\n", results[i].Duration.Round(100*time.Millisecond))
+			}
+		}()
+	}
+	wg.Wait()
+
+	return results
+}
+
+// install an extension's composer dependencies using the given cache
+func composerInstall(out *taggedOutput, extension string, cacheDir string) error {
+	extPath := fmt.Sprintf("%s/%s", EXTENSIONPATH, extension)
+	args := []string{"install", "--no-dev", "--no-interaction", "--quiet"}
+
+	if DRYRUN {
+		out.logf("Would run: cd %s && COMPOSER_CACHE_DIR=%s %s\n", shellWord(extPath), shellWord(cacheDir), renderCommand("", COMPOSERBIN, args))
+		return nil
+	}
+
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return fmt.Errorf("failed to create composer cache %s: %w", cacheDir, err)
+	}
+
+	traceCommand(out, extPath, COMPOSERBIN, args)
+	cmd, ctx, cancel := newCommand(COMPOSERBIN, args...)
+	defer cancel()
+	cmd.Dir = extPath
+	cmd.Env = append(os.Environ(), "COMPOSER_CACHE_DIR="+cacheDir)
+	cmd.Stdout = out.Stdout()
+	cmd.Stderr = out.Stderr()
+
+	if err := checkTimeout(ctx, cmd, cmd.Run()); err != nil {
+		return fmt.Errorf("composer install failed in extension %s: %w", extension, err)
+	}
+
+	return nil
+}
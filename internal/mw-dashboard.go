@@ -0,0 +1,171 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// how often --dashboard redraws its table
+const DASHBOARDREFRESH = 250 * time.Millisecond
+
+// how many of the steps still to run --dashboard shows, so the table fits on a screen even with every
+// extension being upgraded
+const DASHBOARDPENDINGROWS = 5
+
+// the live table of --dashboard; nil when there isn't one
+type dashboard struct {
+	mu    sync.Mutex
+	rows  []*dashboardRow
+	index map[string]*dashboardRow
+	// how many lines the last draw took, so the next one can go over the top of it
+	lines int
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+type dashboardRow struct {
+	server  string
+	step    string
+	status  string
+	started time.Time
+	took    time.Duration
+}
+
+// the dashboard steps are shown in as they run
+var DASHBOARD *dashboard
+
+// whether a file is a terminal rather than e.g. a pipe or a file
+func isTerminal(f *os.File) bool {
+	stat, err := f.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
+
+// start drawing the dashboard, with every step the deploy is expected to run listed as pending; the
+// progress output is hidden while it's up, since it would scroll the table away
+func startDashboard(config *DeployConfig) *dashboard {
+	d := &dashboard{index: map[string]*dashboardRow{}, stop: make(chan struct{}), done: make(chan struct{})}
+
+	for _, server := range config.Servers {
+		if server != HOSTNAME {
+			d.set(server, "sync", "pending")
+			continue
+		}
+
+		if config.UpgradeVendor {
+			d.set(server, "vendor", "pending")
+		}
+		for _, ext := range config.UpgradeExtensions {
+			d.set(server, "extension:"+ext, "pending")
+		}
+		for _, skin := range config.UpgradeSkins {
+			d.set(server, "skin:"+skin, "pending")
+		}
+		d.set(server, "rsync-local", "pending")
+		if config.L10n {
+			d.set(server, "l10n", "pending")
+		}
+	}
+
+	go func() {
+		defer close(d.done)
+		ticker := time.NewTicker(DASHBOARDREFRESH)
+		defer ticker.Stop()
+
+		for {
+			d.draw()
+			select {
+			case <-d.stop:
+				d.draw()
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return d
+}
+
+// set the status of a step on a server, adding it if it isn't there yet
+func (d *dashboard) set(server string, step string, status string) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := server + ":" + step
+	row, ok := d.index[key]
+	if !ok {
+		row = &dashboardRow{server: server, step: step}
+		d.rows = append(d.rows, row)
+		d.index[key] = row
+	}
+
+	switch {
+	case status == "running":
+		row.started = time.Now()
+	case row.status == "running":
+		row.took = time.Since(row.started)
+	}
+	row.status = status
+}
+
+// redraw the table over the top of the last one
+func (d *dashboard) draw() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	counts := map[string]int{}
+	for _, row := range d.rows {
+		counts[row.status]++
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%d running, %d done, %d failed, %d skipped, %d pending\n", counts["running"], counts["done"], counts["failed"], counts["skipped"], counts["pending"])
+
+	w := tabwriter.NewWriter(&buf, 0, 0, 2, ' ', 0)
+	if counts["running"]+counts["failed"]+counts["pending"] > 0 {
+		fmt.Fprintln(w, "SERVER\tSTEP\tSTATUS\tTIME")
+	}
+	pending := 0
+	for _, row := range d.rows {
+		switch row.status {
+		case "running":
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", row.server, row.step, row.status, time.Since(row.started).Round(time.Second))
+		case "failed":
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", row.server, row.step, row.status, row.took.Round(time.Second))
+		case "pending":
+			if pending < DASHBOARDPENDINGROWS {
+				fmt.Fprintf(w, "%s\t%s\t%s\t-\n", row.server, row.step, row.status)
+			}
+			pending++
+		}
+	}
+	if pending > DASHBOARDPENDINGROWS {
+		fmt.Fprintf(w, "...\t%d more pending\t\t\n", pending-DASHBOARDPENDINGROWS)
+	}
+	w.Flush()
+
+	// move back up to the start of the last table and clear everything below it
+	if d.lines > 0 {
+		fmt.Fprintf(os.Stdout, "\x1b[%dA", d.lines)
+	}
+	fmt.Fprint(os.Stdout, "\x1b[J")
+	os.Stdout.Write(buf.Bytes())
+	d.lines = bytes.Count(buf.Bytes(), []byte("\n"))
+}
+
+// stop redrawing, leaving the final table on screen
+func (d *dashboard) close() {
+	if d == nil {
+		return
+	}
+
+	close(d.stop)
+	<-d.done
+}
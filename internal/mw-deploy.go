@@ -1,31 +1,47 @@
 package internal
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
 	"log"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // user used for deploying to other servers
-const DEPLOYUSER = "mediawikiuser"
+var DEPLOYUSER = "mediawikiuser"
+
+// ssh key used for deploying to other servers
+var DEPLOYKEY = "/prod/mediawiki-staging/deploykey"
 
 // hostname; needs to be set from RunDeploy since it returns h, err
 var HOSTNAME string
 
 // path where extensions are located
-const EXTENSIONPATH = "/prod/mediawiki-staging/extensions/"
+var EXTENSIONPATH = "/prod/mediawiki-staging/extensions/"
 
 // path where skins are located
-const SKINPATH = "/prod/mediawiki-staging/skins/"
+var SKINPATH = "/prod/mediawiki-staging/skins/"
 
 // bare path for staging env
-const STAGINGPATH = "/prod/mediawiki-staging"
+var STAGINGPATH = "/prod/mediawiki-staging"
 
 // bare path for prod env
-const PRODUCTIONPATH = "/prod/mediawiki"
+var PRODUCTIONPATH = "/prod/mediawiki"
+
+// default directories, relative to PRODUCTIONPATH, that extensions and skins are deployed to
+const DEFAULTPRODEXTENSIONSDIR = "extensions"
+const DEFAULTPRODSKINSDIR = "skins"
 
 // valid extensions that this script can work on - a extension must exist and have a .git folder to be valid
 var VALIDEXTENSIONS []string
@@ -36,6 +52,52 @@ var VALIDSKINS []string
 // all of the servers that are valid
 var ALLSERVERS = []string{"mw1", "mw2", "mwtask1"}
 
+// the total bandwidth per second --auto-tune shares between parallel syncs; set from the settings file
+// and --bandwidth-budget
+var BANDWIDTHBUDGET = "100M"
+
+// whether every deploy has to say why it's being done with --message; set from the settings file
+var REQUIREDEPLOYMESSAGE bool
+
+// the most remote servers --auto-tune will sync at once
+const AUTOTUNEMAXPARALLEL = 4
+
+// with --resumable, how many times a failed rsync to a remote server is resumed, and how long to wait
+// before each attempt for e.g. a flaky link to come back
+const RESUMABLERETRIES = 3
+const RESUMABLEBACKOFF = 10 * time.Second
+
+// where --resumable keeps partly transferred files, relative to each destination directory; it starts with
+// a dot so the --exclude=.* in runRsync keeps --delete away from it
+const RESUMABLEPARTIALDIR = ".rsync-partial"
+
+// the hosts deploys can be run from; set from the settings file, if it's empty any of ALLSERVERS can be
+var DEPLOYHOSTS []string
+
+// how long a single run of a command (e.g. git or rsync) may take before it's killed; set from
+// --git-timeout and --rsync-timeout, anything not in here can run forever
+var COMMANDTIMEOUTS = map[string]time.Duration{}
+
+// the php and composer binaries to run, for servers with more than one version installed; set from the
+// settings file, --php-bin and --composer-bin
+var PHPBIN = "php"
+var COMPOSERBIN = "composer"
+
+// set from --dry-run; nothing which changes anything is run, rsync only reports what it would change
+var DRYRUN bool
+
+// set from --verbose; every command is printed exactly as it's run, including the read only ones
+var VERBOSE bool
+
+// returned when a command took longer than its timeout
+var ErrTimeout = errors.New("timed out")
+
+// returned when pulling a repo conflicts with its local changes
+var ErrMergeConflict = errors.New("merge conflict")
+
+// returned when a repo has local commits which aren't upstream and upstream has moved on
+var ErrDiverged = errors.New("local branch has diverged from upstream")
+
 // all possible deploy options
 type DeployConfig struct {
 	UpgradeExtensions []string
@@ -48,73 +110,566 @@ type DeployConfig struct {
 	IgnoreTime        bool
 	Force             bool
 	SyncConfig        bool
+	Compress          bool
+	CompressServers   []string
+	Canary            string
+	HealthCheckURL    string
+	AbortOnDirty      bool
+	Include           []string
+	Shallow           bool
+	Resume            bool
+	ReportFormat      string
+	ReportFile        string
+	ProdExtensionsDir string
+	ProdSkinsDir      string
+	AllowMerge        bool
+	Only              []string
+	WarmCache         bool
+	WarmCacheURLs     []string
+	GitTimeout        time.Duration
+	RsyncTimeout      time.Duration
+	NoVersionMarker   bool
+	PreDeployHook     string
+	PostDeployHook    string
+	Explain           bool
+	Atomic            bool
+	PushOnly          string
+	L10nMergeScript   string
+	L10nExtensionsDir string
+	ContinueOnVendor  bool
+	ContinueOnExt     bool
+	ContinueOnSkin    bool
+	ContinueOnL10n    bool
+	ContinueOnServer  bool
+	DryRun            bool
+	MaxStagingAge     time.Duration
+	Backup            bool
+	HealthCheck       bool
+	HealthRetries     int
+	HealthParallel    int
+	WatchErrorLog     string
+	WatchErrorWindow  time.Duration
+	ErrorLogThreshold int
+	NoRemote          bool
+	WriteLock         string
+	Lock              *deployLock
+	MaxFileSize       int64
+	OnlyChanged       bool
+	PHPBin            string
+	ComposerBin       string
+	RecordManifest    string
+	SummaryOnly       bool
+	SSHPort           int
+	Ordered           bool
+	AllowAnyHost      bool
+	RefetchTags       bool
+	MaxParallel       int
+	BwLimit           string
+	AutoTune          bool
+	BandwidthBudget   int64
+	Message           string
+	RemoteL10n        string
+	L10nCacheDir      string
+	Verbose           bool
+	ExcludeServers    []string
+	NoVendorReset     bool
+	Resumable         bool
+	Lint              bool
+	FromArtifacts     bool
+	ArtifactURL       string
+	Yes               bool
+	L10nScope         string
+	ExtensionComposer bool
+	ComposerParallel  int
+	VendorOnly        bool
+	EncryptedKey      string
+	AgeIdentity       string
+	SSHAgent          bool
+	Strict            bool
+	ExtensionHooks    bool
+	CompareRef        string
+	Chmod             string
+	Dashboard         bool
+	OnlyChangedRepos  bool
+	Stats             bool
+	SinceCommit       string
+	RollbackTo        string
+	NotifyWebhook     string
+	NotifyFailureOnly bool
+	Worktree          bool
+	SlowWarn          time.Duration
+	Releases          bool
+	KeepReleases      int
+	MetricsFile       string
+	IgnoreMaintenance []string
+	KeepBackups       int
+
+	// the commit each extension and skin was at before this deploy pulled it, keyed by path
+	pulledFrom map[string]string
+	// the languages the localization cache was rebuilt for here, which remote rebuilds follow
+	l10nScope *l10nScope
+	// the extensions and skins --only-changed-repos dropped, keyed by e.g. extension:Echo
+	unchanged map[string]bool
+	// the --worktree checkout of each extension and skin, keyed by the path of its staging checkout, and
+	// the temporary directory they're all in
+	worktrees   map[string]string
+	worktreeDir string
+	// the release --releases is building, until it's made live
+	release string
+}
+
+// the flag which lets the deploy carry on after a failure of this class of step, if any was passed;
+// --force tolerates every failure, the --continue-on-*-error flags only their own class
+func (c *DeployConfig) toleratingFlag(class string) string {
+	if c.Force {
+		return "--force"
+	}
+
+	tolerated := map[string]bool{
+		"vendor":    c.ContinueOnVendor,
+		"extension": c.ContinueOnExt,
+		"skin":      c.ContinueOnSkin,
+		"l10n":      c.ContinueOnL10n,
+		"server":    c.ContinueOnServer,
+	}
+
+	if tolerated[class] {
+		return "--continue-on-" + class + "-error"
+	}
+
+	return ""
+}
+
+// a flag which can be passed multiple times, e.g. --include=.htaccess --include=.well-known
+type stringList []string
+
+func (s *stringList) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringList) Set(value string) error {
+	*s = append(*s, value)
+	return nil
 }
 
 // actually run the deploy
 func RunDeploy(args []string) {
-	hname, err := os.Hostname()
+	hname, err := getShortHostname()
+
+	if err != nil {
+		ExitWithError(fmt.Errorf("could not determine hostname: %w", err), 1)
+	}
+
+	HOSTNAME = hname
 
+	config, err := parseFlags(args)
 	if err != nil {
-		fmt.Println("Could not determine hostname...", err)
-		os.Exit(1)
+		ExitWithError(err, EXITCONFIG)
 	}
 
-	HOSTNAME = strings.Split(hname, ".")[0]
+	// staging and production paths only make sense on a deploy host, anywhere else we'd be syncing
+	// from paths which don't exist or belong to something else
+	if !config.AllowAnyHost && !isDeployHost(HOSTNAME) {
+		ExitWithError(fmt.Errorf("%s isn't a deploy host, expected one of %v (use --allow-any-host to deploy from here anyway)", HOSTNAME, deployHosts()), EXITCONFIG)
+	}
 
-	config := parseFlags(args)
+	DRYRUN = config.DryRun
+	VERBOSE = config.Verbose
+	if config.Stats && !config.DryRun {
+		RSYNCSTATS = newRsyncStatsCollector()
+	}
+	SUMMARYONLY = config.SummaryOnly
+	SSHPORT = config.SSHPort
+	PHPBIN = config.PHPBin
+	COMPOSERBIN = config.ComposerBin
+	COMMANDTIMEOUTS["git"] = config.GitTimeout
+	COMMANDTIMEOUTS["rsync"] = config.RsyncTimeout
+
+	selections, err := planDeploy(config)
+	if err != nil {
+		ExitWithError(err, exitCodeOf(err))
+	}
 
-	// --upgrade-world is a helper to do everything
-	if config.UpgradeWorld {
-		config.UpgradeExtensions = VALIDEXTENSIONS
-		config.UpgradeSkins = VALIDSKINS
-		config.UpgradeVendor = true
-		config.L10n = true
-		config.IgnoreTime = true
+	if config.OnlyChangedRepos && len(config.UpgradeExtensions) == 0 && len(config.UpgradeSkins) == 0 && !config.UpgradeVendor && !config.SyncConfig && !config.L10n {
+		if config.Explain {
+			printSelection(selections)
+		}
+		logf("Nothing selected has changed, there's nothing to deploy\n")
+		return
+	}
+
+	if config.Explain {
+		printSelection(selections)
+	}
+
+	if config.CompareRef != "" {
+		printDeployedComparison(config)
+	}
+
+	if err := confirmNewSettings(config); err != nil {
+		ExitWithError(err, EXITCONFIG)
+	}
+
+	agent, err := setupDeployKey(config)
+	if err != nil {
+		ExitWithError(err, EXITCONFIG)
+	}
+
+	if config.AutoTune {
+		logf("Auto-tuned to --max-parallel=%d --bwlimit=%s\n", config.MaxParallel, config.BwLimit)
+	}
+
+	if config.RollbackTo != "" {
+		logf("Rolling back to the deploy recorded at %s\n", config.Lock.WrittenAt)
 	}
 
-	VALIDEXTENSIONS = GetValidExtensions()
-	VALIDSKINS = GetValidSkins()
+	if config.PushOnly != "" {
+		logf("Pushing the local production tree %s on %s to %s as it is, no git, composer or l10n will be run\n", PRODUCTIONPATH, HOSTNAME, config.PushOnly)
+	} else if config.VendorOnly {
+		logf("Deploying only vendor to servers: %v\n", config.Servers)
+	} else {
+		logf("Deploying to servers: %v\n", config.Servers)
+	}
 
-	// validate our config is valid first before we do anything
-	if err := validateConfig(config); err != nil {
-		log.Fatal(err)
+	// a dry run didn't happen as far as anyone following the deploy log is concerned
+	if !config.DryRun {
+		if DEPLOYLOG, err = openDeployLog(args, config.Message); err != nil {
+			logf("%v\n", err)
+		}
 	}
 
-	fmt.Printf("Deploying to servers: %v\n", config.Servers)
+	// the table is redrawn in place, which only works on a terminal
+	if config.Dashboard {
+		if !isTerminal(os.Stdout) || JSONOUTPUT || config.SummaryOnly {
+			logf("Not showing --dashboard, stdout isn't a terminal or is already used for --json or --summary-only\n")
+		} else {
+			DASHBOARD = startDashboard(config)
+		}
+	}
 
 	// actually execute the deploy
-	if err := executeDeploy(config); err != nil {
-		log.Fatal(err)
+	startedAt := time.Now()
+	results, err := executeDeploy(config)
+	DASHBOARD.close()
+	DASHBOARD = nil
+	DEPLOYLOG.finish(err)
+	agent.stop()
+
+	report := newDeployReport(results, startedAt, time.Now(), err)
+	report.Message = config.Message
+	report.addTransferStats(RSYNCSTATS)
+
+	if config.SummaryOnly {
+		printSummary(resultOutput(), report)
+	} else {
+		printResults(results)
+		if RSYNCSTATS != nil {
+			RSYNCSTATS.print(progressOutput())
+		}
+	}
+
+	if config.ReportFormat != "" {
+		if err := writeReport(report, config.ReportFormat, config.ReportFile); err != nil {
+			logf("%v\n", err)
+		}
 	}
 
-	fmt.Println("Deploy completed successfully")
+	// like the other records of a deploy, failing to write metrics doesn't change how the deploy went
+	if config.MetricsFile != "" && !config.DryRun {
+		if err := writeMetricsFile(config.MetricsFile, report); err != nil {
+			logf("%v\n", err)
+		}
+	}
+
+	if config.DryRun {
+		DRYRUNPLAN.print()
+	}
+
+	if JSONOUTPUT {
+		printJSON(report)
+	}
+
+	if err == nil && config.WriteLock != "" && !config.DryRun {
+		if lockErr := writeDeployLock(config.WriteLock, currentDeployLock(config)); lockErr != nil {
+			logf("Failed to write lock file: %v\n", lockErr)
+		} else {
+			logf("Wrote lock file %s\n", config.WriteLock)
+		}
+	}
+
+	// the manifest is only a record, it mustn't fail a deploy which has already happened
+	if err == nil && config.RecordManifest != "" && !config.DryRun {
+		if manifestErr := recordManifest(config.RecordManifest, config); manifestErr != nil {
+			logf("Failed to record the deploy in %s: %v\n", config.RecordManifest, manifestErr)
+		} else {
+			logf("Recorded the deploy in %s\n", config.RecordManifest)
+		}
+	}
+
+	if config.Lock != nil && !config.DryRun && !config.Worktree {
+		logf("The deployed repos in staging are now detached at the locked commits, check their branches out again before the next deploy\n")
+	}
+
+	// exit with a code for the kind of failure so wrappers can tell what went wrong; how many servers
+	// failed is in the report
+	if err != nil {
+		if !JSONOUTPUT {
+			log.Print(err)
+		}
+		os.Exit(exitCodeOf(err))
+	}
+
+	logf("Deploy completed successfully\n")
+}
+
+// get the hostname of this server without the domain, e.g. mw1 rather than mw1.example.org,
+// which is how servers are named in ALLSERVERS
+func getShortHostname() (string, error) {
+	hname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Split(hname, ".")[0], nil
+}
+
+// the hosts deploys can be run from
+func deployHosts() []string {
+	if len(DEPLOYHOSTS) > 0 {
+		return DEPLOYHOSTS
+	}
+	return ALLSERVERS
+}
+
+// check whether deploys can be run from a host
+func isDeployHost(host string) bool {
+	return contains(deployHosts(), host)
 }
 
+// what rsync accepts for --chmod: comma separated octal modes or chmod style rules, each optionally only
+// for directories (D) or files (F)
+var rsyncChmodPattern = regexp.MustCompile(`^[DF]?([0-7]{3,4}|[ugoa]*[-+=][rwxXst]*)(,[DF]?([0-7]{3,4}|[ugoa]*[-+=][rwxXst]*))*$`)
+
 // Parse the flags passed to the script so we know what we're doing
-func parseFlags(args []string) *DeployConfig {
+func parseFlags(args []string) (*DeployConfig, error) {
 	deployCmd := flag.NewFlagSet("deploy", flag.ExitOnError)
 
-	upgradeExtensions := deployCmd.String("upgrade-extensions", "", "Comma separated extensions to upgrade")
-	upgradeSkins := deployCmd.String("upgrade-skins", "", "Comma separated skins to upgrade")
+	upgradeExtensions := deployCmd.String("upgrade-extensions", "", "Comma separated extensions to upgrade, or all")
+	upgradeSkins := deployCmd.String("upgrade-skins", "", "Comma separated skins to upgrade, or all")
 	upgradeVendor := deployCmd.Bool("upgrade-vendor", false, "Update vendor directory (Composer dependencies)")
+	vendorOnly := deployCmd.Bool("vendor-only", false, "Update and deploy only vendor, skipping extension and skin discovery and l10n entirely")
 	upgradeWorld := deployCmd.Bool("upgrade-world", false, "Update everything (vendor, all extensions, all skins, l10n)")
 	l10n := deployCmd.Bool("l10n", false, "Rebuild localization cache")
 	lang := deployCmd.String("lang", "", "Specific languages for l10n (comma-separated)")
 	servers := deployCmd.String("servers", "", "Target servers (comma-separated)")
+	serversFromFile := deployCmd.String("servers-from-file", "", "File listing target servers, one per line (merged with --servers)")
+	serversFileFormat := deployCmd.String("servers-file-format", SERVERSFILETEXT, "Format of --servers-from-file: text (one server per line) or json (an inventory which can also give each server its own ssh_port, ssh_user and ssh_key, and adds servers which aren't in the settings file)")
+	role := deployCmd.String("role", "", "Only deploy to the servers in a --servers-file-format=json inventory with this role")
+	serversMatch := deployCmd.String("servers-match", "", "Regex which whole server names must match to be targeted, e.g. 'mw[0-9]+' (merged with --servers)")
+	excludeServers := deployCmd.String("exclude-servers", "", "Comma separated servers to leave out, e.g. one in maintenance (applied after --servers, --servers-from-file and --servers-match)")
 	ignoreTime := deployCmd.Bool("ignore-time", false, "Use --inplace instead of --update for rsync")
 	force := deployCmd.Bool("force", false, "Force deployment even on errors")
 	syncConfig := deployCmd.Bool("config", false, "Sync the entire root directory (including LocalSettings.php)")
-
+	compress := deployCmd.Bool("compress", false, "Compress rsync transfers to all remote servers (-z)")
+	compressServers := deployCmd.String("compress-servers", "", "Comma separated remote servers to compress rsync transfers to")
+	canary := deployCmd.String("canary", "", "Server to deploy to and health check first; the rest only proceed if it passes")
+	healthCheckURL := deployCmd.String("health-check-url", DEFAULTHEALTHCHECKURL, "URL used to health check a server ({server} is replaced with the server name)")
+	abortOnDirty := deployCmd.Bool("abort-on-dirty", true, "Abort if any repo to be upgraded has uncommitted or untracked changes")
+	allowDirty := deployCmd.Bool("allow-dirty", false, "Deploy even if repos to be upgraded have uncommitted or untracked changes")
+	var include stringList
+	deployCmd.Var(&include, "include", "Dotfile pattern to sync despite the default --exclude=.* (repeatable)")
+	shallow := deployCmd.Bool("shallow", false, "Keep extensions and skins which are shallow clones shallow, fetching only the latest commit of their upstream (git fetch --depth=1) and resetting to it; full clones are pulled as usual")
+	resume := deployCmd.Bool("resume", false, "Resume the previous deploy, skipping the steps it already completed")
+	reportFormat := deployCmd.String("report-format", "", "Write a report of the deploy in this format (json or junit)")
+	reportFile := deployCmd.String("report-file", "", "File to write the report to (defaults to stdout)")
+	prodExtensionsDir := deployCmd.String("prod-extensions-dir", DEFAULTPRODEXTENSIONSDIR, "Directory (relative to the production path) extensions are deployed to")
+	prodSkinsDir := deployCmd.String("prod-skins-dir", DEFAULTPRODSKINSDIR, "Directory (relative to the production path) skins are deployed to")
+	only := deployCmd.String("only", "", "Comma separated extensions and skins to restrict --upgrade-world to")
+	warmCache := deployCmd.Bool("warm-cache", false, "Request key URLs on every server after the deploy to warm caches")
+	warmCacheURLs := deployCmd.String("warm-cache-urls", DEFAULTWARMCACHEURLS, "Comma separated URLs to request for --warm-cache ({server} is replaced with the server name)")
+	gitTimeout := deployCmd.Duration("git-timeout", 0, "Kill any single git command which runs longer than this (e.g. 5m)")
+	rsyncTimeout := deployCmd.Duration("rsync-timeout", 0, "Kill any single rsync which runs longer than this (e.g. 15m)")
+	noVersionMarker := deployCmd.Bool("no-version-marker", false, "Don't write a "+DEPLOYEDMARKER+" file into each deployed extension and skin")
+	preDeployHook := deployCmd.String("pre-deploy-hook", "", "Executable to run before the deploy starts; the deploy is aborted if it fails")
+	postDeployHook := deployCmd.String("post-deploy-hook", "", "Executable to run once the deploy has finished, whether it succeeded or not")
+	explain := deployCmd.Bool("explain", false, "Show why each extension and skin was or wasn't selected")
+	atomic := deployCmd.Bool("atomic", false, "Stage all changed files and rename them into place together at the end of each rsync (--delay-updates); needs extra temporary disk space")
+	pushOnly := deployCmd.String("push-only", "", "Sync this server from the local production tree as it is, without running git, composer or l10n")
+	l10nMergeScript := deployCmd.String("l10n-merge-script", "", "Path to mergeMessageFileList.php (defaults to the one in the TelepediaMagic extension)")
+	l10nExtensionsDir := deployCmd.String("l10n-extensions-dir", "", "Colon separated --extensions-dir passed to the merge script (defaults to the production extensions and skins directories)")
+	continueOnVendor := deployCmd.Bool("continue-on-vendor-error", false, "Carry on if updating vendor fails")
+	continueOnExt := deployCmd.Bool("continue-on-extension-error", false, "Carry on if updating an extension fails")
+	continueOnSkin := deployCmd.Bool("continue-on-skin-error", false, "Carry on if updating a skin fails")
+	continueOnL10n := deployCmd.Bool("continue-on-l10n-error", false, "Carry on if rebuilding the localization cache fails")
+	continueOnServer := deployCmd.Bool("continue-on-server-error", false, "Carry on to the other servers if syncing to a remote server fails")
+	dryRun := deployCmd.Bool("dry-run", false, "Don't change anything, only show the commands which would run and what rsync would change")
+	maxStagingAge := deployCmd.Duration("max-staging-age", 0, "Refuse (or with --force, warn) if any repo to be upgraded was last fetched longer ago than this (e.g. 336h)")
+	backup := deployCmd.Bool("backup", false, "Take a hard linked snapshot of production before syncing into it, which utils rollback can restore")
+	healthCheck := deployCmd.Bool("health-check", false, "Health check every server once the deploy has finished")
+	healthRetries := deployCmd.Int("health-check-retries", 0, "Retry a failed health check this many times, backing off between attempts")
+	healthParallel := deployCmd.Int("health-check-parallel", 8, "Maximum number of servers to health check at once")
+	watchErrorLog := deployCmd.String("watch-error-log", "", "Error log to watch on every server after the deploy for new fatals and errors")
+	watchErrorWindow := deployCmd.Duration("watch-error-window", time.Minute, "How long to watch the error log for with --watch-error-log")
+	errorLogThreshold := deployCmd.Int("error-log-threshold", 1, "How many new error log entries on a server fail it with --watch-error-log")
+	noRemote := deployCmd.Bool("no-remote", false, "Only deploy to this server, skipping every remote server whatever --servers says")
+	writeLock := deployCmd.String("write-lock", "", "After a successful deploy, write the sha every extension, skin and vendor is deployed at to this file")
+	fromLock := deployCmd.String("from-lock", "", "Deploy exactly the shas recorded in a lock file written by --write-lock")
+	maxFileSize := deployCmd.String("max-file-size", "", "Refuse (or with --force, warn) if any file about to be synced is bigger than this (e.g. 50M)")
+	onlyChanged := deployCmd.Bool("only-changed-servers", false, "Probe each remote server with an rsync dry run first and skip any which are already in sync (see --only-changed-repos to skip extensions and skins instead)")
+	phpBin := deployCmd.String("php-bin", PHPBIN, "PHP binary used to run maintenance scripts")
+	composerBin := deployCmd.String("composer-bin", COMPOSERBIN, "Composer binary used to update vendor")
+	recordManifest := deployCmd.String("record-manifest", "", "After a successful deploy, commit the sha everything is deployed at to "+MANIFESTFILE+" in this git repo")
+	summaryOnly := deployCmd.Bool("summary-only", false, "Don't show any progress, only a summary once the deploy has finished")
+	sshPort := deployCmd.Int("ssh-port", SSHPORT, "SSH port for remote servers which don't have their own in the settings file")
+	ordered := deployCmd.Bool("ordered", false, "Deploy extensions one at a time in exactly the order given to --upgrade-extensions, without reordering them by their dependencies or running anything in parallel")
+	allowAnyHost := deployCmd.Bool("allow-any-host", false, "Deploy even if this host isn't a known deploy host")
+	refetchTags := deployCmd.Bool("refetch-tags", false, "Fetch every tag again, replacing any which moved upstream, in each repo before upgrading it")
+	maxParallel := deployCmd.Int("max-parallel", 1, "Maximum number of remote servers to sync at once (always 1 with --ordered)")
+	bwLimit := deployCmd.String("bwlimit", "", "Limit the bandwidth of each rsync to a remote server, in rsync's --bwlimit format (e.g. 5M)")
+	autoTune := deployCmd.Bool("auto-tune", false, "Pick --max-parallel and --bwlimit from the number of remote servers and --bandwidth-budget, unless they're given")
+	bandwidthBudget := deployCmd.String("bandwidth-budget", BANDWIDTHBUDGET, "Total bandwidth per second --auto-tune shares between parallel syncs (e.g. 100M)")
+	message := deployCmd.String("message", "", "Why this deploy is being done (e.g. \"hotfix for T12345\"), recorded in the deploy log, report and deployed markers")
+	remoteL10n := deployCmd.String("remote-l10n", REMOTEL10NNONE, "How remote servers get their localization cache with --l10n: none, rebuild (run the rebuild on each over ssh) or sync (copy the one built here)")
+	l10nCacheDir := deployCmd.String("l10n-cache-dir", DEFAULTL10NCACHEDIR, "Directory (relative to the production path) the localization cache is built in, synced by --remote-l10n=sync")
+	extensionComposer := deployCmd.Bool("extension-composer", false, "Run composer install in each upgraded extension which has its own composer.json")
+	composerParallel := deployCmd.Int("composer-parallel", 4, "Maximum number of extensions to run composer install in at once with --extension-composer (always 1 with --ordered)")
+	l10nScopeFlag := deployCmd.String("l10n-scope", L10NSCOPEFULL, "What --l10n rebuilds: full (every language) or auto (only the languages whose messages changed in the upgraded extensions and skins, or everything if vendor, core or a manifest changed)")
+	yes := deployCmd.Bool("yes", false, "Confirm deploying with settings which haven't been deployed with before, without being asked")
+	fromArtifacts := deployCmd.Bool("from-artifacts", false, "Update extensions by downloading their tarballs from CI instead of pulling git, checking each against its published sha256")
+	artifactURL := deployCmd.String("artifact-url", ARTIFACTURL, "URL of extension tarballs for --from-artifacts; {extension} is replaced with the extension name and the sha256 must be at the same URL with .sha256 on the end")
+	lint := deployCmd.Bool("lint", false, "Run php -l on the php files each extension and skin pull changes, putting the repo back and failing its update if any don't parse")
+	resumable := deployCmd.Bool("resumable", false, fmt.Sprintf("Keep partly transferred files when an rsync to a remote server fails and resume it, up to %d times", RESUMABLERETRIES))
+	noVendorReset := deployCmd.Bool("no-vendor-reset", false, "Don't hard reset vendor before pulling it, only fast-forward it, failing if it has local changes (for working on the staging box)")
+	encryptedKey := deployCmd.String("encrypted-key", "", "Age (.age) or gpg (.gpg, .asc) encrypted deploy key to decrypt in memory and load into an ssh-agent for the deploy, instead of passing the deploy key path to ssh")
+	ageIdentity := deployCmd.String("age-identity", "", "Age identity file used to decrypt an --encrypted-key ending in .age")
+	sshAgent := deployCmd.Bool("ssh-agent", false, "Use the deploy key from the already running ssh-agent (SSH_AUTH_SOCK) instead of passing the deploy key path to ssh")
+	compareRef := deployCmd.String("compare-ref", "", "Before deploying, show the commits between the sha each extension and skin is deployed at (from its "+DEPLOYEDMARKER+") and this ref in staging, e.g. @{upstream}; with --from-lock the locked sha is used instead")
+	keepBackups := deployCmd.Int("keep-backups", 10, "How many backups --backup keeps, including the one it takes; older ones are removed after each backup")
+	ignoreMaintenance := deployCmd.String("ignore-running-maintenance", DEFAULTIGNOREDMAINTENANCE, "Comma separated maintenance scripts which can be left running during a deploy, such as job runners which always are (e.g. runJobs.php); pass an empty value to refuse to deploy while any is running")
+	metricsFile := deployCmd.String("metrics-file", "", "After the deploy, update the Prometheus metrics in this file (e.g. in node_exporter's textfile collector directory, ending in .prom) with how it went and how long each step took")
+	releases := deployCmd.Bool("releases", false, "Sync this server into a new release directory next to production, hard linked from the live one, and switch the production symlink over to it once it's built; utils switch-release switches back")
+	keepReleases := deployCmd.Int("keep-releases", 5, "How many releases --releases keeps, including the live one")
+	slowWarn := deployCmd.Duration("slow-warn", 0, "Say every time a step (e.g. updating an extension, or an rsync to a server) has run for this long again, without stopping it (e.g. 5m)")
+	worktree := deployCmd.Bool("worktree", false, "Check each extension and skin out into a temporary git worktree at its upstream (or locked) commit and deploy from that, leaving the staging checkouts as they are")
+	notifyWebhook := deployCmd.String("notify-webhook", "", "URL to POST a JSON notification of how the deploy went to once it has finished, which Slack incoming webhooks can show as it is")
+	notifyOnFailureOnly := deployCmd.Bool("notify-on-failure-only", false, "Only send the --notify-webhook notification if the deploy failed, or had failures forced through")
+	rollbackTo := deployCmd.String("rollback-to", "", "Roll back to a previous deploy: redeploy exactly the shas in a lock file (from --write-lock, or a "+MANIFESTFILE+"), or those the last deploy recorded in the --record-manifest repo at or before a time (e.g. '2006-01-02 15:04'), and rebuild l10n")
+	stats := deployCmd.Bool("stats", false, "Have rsync count how many files and bytes each sync transferred, totalled per server at the end and in the report")
+	onlyChangedRepos := deployCmd.Bool("only-changed-repos", false, "Only upgrade the selected extensions and skins whose upstream has commits the pull would bring in (as of the last fetch, see utils fetch-all); see --only-changed-servers to skip servers instead")
+	sinceCommit := deployCmd.String("since-commit", "", "With --only-changed-repos, only upgrade the extensions and skins whose upstream has commits since this ref (e.g. a release tag) instead; any without it are upgraded anyway")
+	dashboardFlag := deployCmd.Bool("dashboard", false, "Show a table of every step on every server and its status, redrawn in place as the deploy runs, instead of the progress output (only on a terminal)")
+	chmod := deployCmd.String("chmod", "", "Set the permissions of everything synced into production to these, in rsync's --chmod format (e.g. D755,F644), rather than whatever they are in staging")
+	parallelServers := deployCmd.Bool("parallel-servers", false, "Deploy to the canary (--canary, or else the first remote server) and health check it on its own, then to every other remote server at once unless --max-parallel says otherwise")
+	extensionHooks := deployCmd.Bool("extension-hooks", false, "Run the maintenance scripts upgraded extensions ask for in telepedia.deployHooks in their extension.json, which are otherwise ignored")
+	strict := deployCmd.Bool("strict", false, "Fail the deploy if any warning is given, or any failure is let through by --force or a --continue-on-*-error flag")
+	verbose := deployCmd.Bool("verbose", false, "Print every command (including git and rsync) exactly as it's run, quoted so it can be copied into a shell; with --dry-run the ones which would change something are printed instead")
+	allowMerge := deployCmd.Bool("allow-merge", false, "Allow pulls to create merge commits instead of only fast-forwarding")
+
+	deployCmd.Usage = func() {
+		fmt.Fprintf(deployCmd.Output(), "Usage of deploy:\n")
+		deployCmd.PrintDefaults()
+		printExitCodes(deployCmd.Output())
+	}
 	deployCmd.Parse(args)
 
 	config := &DeployConfig{
-		UpgradeVendor: *upgradeVendor,
-		UpgradeWorld:  *upgradeWorld,
-		L10n:          *l10n,
-		Lang:          *lang,
-		IgnoreTime:    *ignoreTime,
-		Force:         *force,
-		SyncConfig:    *syncConfig,
+		UpgradeVendor:     *upgradeVendor,
+		UpgradeWorld:      *upgradeWorld,
+		L10n:              *l10n,
+		Lang:              *lang,
+		IgnoreTime:        *ignoreTime,
+		Force:             *force,
+		SyncConfig:        *syncConfig,
+		Compress:          *compress,
+		Canary:            *canary,
+		HealthCheckURL:    *healthCheckURL,
+		AbortOnDirty:      *abortOnDirty && !*allowDirty,
+		Include:           include,
+		Shallow:           *shallow,
+		Resume:            *resume,
+		ReportFormat:      *reportFormat,
+		ReportFile:        *reportFile,
+		ProdExtensionsDir: *prodExtensionsDir,
+		ProdSkinsDir:      *prodSkinsDir,
+		AllowMerge:        *allowMerge,
+		WarmCache:         *warmCache,
+		WarmCacheURLs:     strings.Split(*warmCacheURLs, ","),
+		GitTimeout:        *gitTimeout,
+		RsyncTimeout:      *rsyncTimeout,
+		NoVersionMarker:   *noVersionMarker,
+		PreDeployHook:     *preDeployHook,
+		PostDeployHook:    *postDeployHook,
+		Explain:           *explain,
+		Atomic:            *atomic,
+		PushOnly:          *pushOnly,
+		L10nMergeScript:   *l10nMergeScript,
+		L10nExtensionsDir: *l10nExtensionsDir,
+		ContinueOnVendor:  *continueOnVendor,
+		ContinueOnExt:     *continueOnExt,
+		ContinueOnSkin:    *continueOnSkin,
+		ContinueOnL10n:    *continueOnL10n,
+		ContinueOnServer:  *continueOnServer,
+		DryRun:            *dryRun,
+		MaxStagingAge:     *maxStagingAge,
+		Backup:            *backup,
+		HealthCheck:       *healthCheck,
+		HealthRetries:     *healthRetries,
+		HealthParallel:    *healthParallel,
+		WatchErrorLog:     *watchErrorLog,
+		WatchErrorWindow:  *watchErrorWindow,
+		ErrorLogThreshold: *errorLogThreshold,
+		NoRemote:          *noRemote,
+		WriteLock:         *writeLock,
+		OnlyChanged:       *onlyChanged,
+		PHPBin:            *phpBin,
+		ComposerBin:       *composerBin,
+		RecordManifest:    *recordManifest,
+		SummaryOnly:       *summaryOnly,
+		SSHPort:           *sshPort,
+		Ordered:           *ordered,
+		AllowAnyHost:      *allowAnyHost,
+		RefetchTags:       *refetchTags,
+		MaxParallel:       *maxParallel,
+		BwLimit:           *bwLimit,
+		AutoTune:          *autoTune,
+		Message:           *message,
+		RemoteL10n:        *remoteL10n,
+		L10nCacheDir:      *l10nCacheDir,
+		Verbose:           *verbose,
+		NoVendorReset:     *noVendorReset,
+		Resumable:         *resumable,
+		Lint:              *lint,
+		FromArtifacts:     *fromArtifacts,
+		ArtifactURL:       *artifactURL,
+		Yes:               *yes,
+		L10nScope:         *l10nScopeFlag,
+		ExtensionComposer: *extensionComposer,
+		ComposerParallel:  *composerParallel,
+		VendorOnly:        *vendorOnly,
+		EncryptedKey:      *encryptedKey,
+		AgeIdentity:       *ageIdentity,
+		SSHAgent:          *sshAgent,
+		Strict:            *strict,
+		ExtensionHooks:    *extensionHooks,
+		CompareRef:        *compareRef,
+		Chmod:             *chmod,
+		Dashboard:         *dashboardFlag,
+		OnlyChangedRepos:  *onlyChangedRepos,
+		Stats:             *stats,
+		SinceCommit:       *sinceCommit,
+		RollbackTo:        *rollbackTo,
+		NotifyWebhook:     *notifyWebhook,
+		NotifyFailureOnly: *notifyOnFailureOnly,
+		Worktree:          *worktree,
+		SlowWarn:          *slowWarn,
+		Releases:          *releases,
+		KeepReleases:      *keepReleases,
+		MetricsFile:       *metricsFile,
+		KeepBackups:       *keepBackups,
+	}
+
+	if *ignoreMaintenance != "" {
+		config.IgnoreMaintenance = strings.Split(*ignoreMaintenance, ",")
 	}
 
 	if *upgradeExtensions != "" {
@@ -125,6 +680,14 @@ func parseFlags(args []string) *DeployConfig {
 		config.UpgradeSkins = strings.Split(*upgradeSkins, ",")
 	}
 
+	if *only != "" {
+		config.Only = strings.Split(*only, ",")
+	}
+
+	if *compressServers != "" {
+		config.CompressServers = strings.Split(*compressServers, ",")
+	}
+
 	if *servers != "" {
 		if *servers == "all" {
 			config.Servers = ALLSERVERS
@@ -133,307 +696,1770 @@ func parseFlags(args []string) *DeployConfig {
 		}
 	}
 
-	return config
-}
-
-// validate that what the user asked for is actually valid
-func validateConfig(config *DeployConfig) error {
-	for _, ext := range config.UpgradeExtensions {
-		if !contains(VALIDEXTENSIONS, ext) {
-			return fmt.Errorf("invalid extension: %s", ext)
-		}
-	}
-
-	for _, skin := range config.UpgradeSkins {
-		if !contains(VALIDSKINS, skin) {
-			return fmt.Errorf("invalid skin: %s", skin)
+	// pushing only ever targets the one server, the local work is skipped since we aren't in the list
+	if *pushOnly != "" {
+		if *servers != "" || *serversFromFile != "" || *serversMatch != "" {
+			return nil, fmt.Errorf("--push-only can't be combined with --servers, --servers-from-file or --servers-match")
 		}
+		config.Servers = []string{*pushOnly}
 	}
 
-	if len(config.Servers) == 0 {
-		return fmt.Errorf("at least one server required")
+	if *role != "" && *serversFileFormat != SERVERSFILEJSON {
+		return nil, fmt.Errorf("--role needs --servers-file-format=%s, only an inventory gives servers roles", SERVERSFILEJSON)
 	}
 
-	if config.Lang != "" && !config.L10n {
-		return fmt.Errorf("--lang requires --l10n flag")
+	// otherwise it'd be ignored and the deploy would go to every server
+	if *role != "" && *serversFromFile == "" {
+		return nil, fmt.Errorf("--role needs --servers-from-file, it picks servers from the inventory in it")
 	}
 
-	return nil
-}
+	if *serversFromFile != "" {
+		var fileServers []string
+		var err error
+
+		switch *serversFileFormat {
+		case SERVERSFILETEXT:
+			fileServers, err = readServersFile(*serversFromFile)
+		case SERVERSFILEJSON:
+			var inventory []inventoryServer
+			inventory, err = readServerInventory(*serversFromFile)
+			for _, server := range inventory {
+				if *role == "" || contains(server.Roles, *role) {
+					server.register()
+					fileServers = append(fileServers, server.Name)
+				}
+			}
+			if err == nil && len(fileServers) == 0 {
+				err = fmt.Errorf("no servers in %s have the role %s", *serversFromFile, *role)
+			}
+		default:
+			err = fmt.Errorf("invalid --servers-file-format %s, expected %s or %s", *serversFileFormat, SERVERSFILETEXT, SERVERSFILEJSON)
+		}
+		if err != nil {
+			return nil, err
+		}
 
-// get all of the valid extensions - in order to be valid, it must exist in the extension path, and be
-// a git repository
-func GetValidExtensions() []string {
-	var validExtensions []string
-	entries, err := os.ReadDir(EXTENSIONPATH)
-	if err != nil {
-		log.Fatal(err)
+		for _, server := range fileServers {
+			if !contains(config.Servers, server) {
+				config.Servers = append(config.Servers, server)
+			}
+		}
 	}
 
-	for _, ext := range entries {
-		if !ext.IsDir() {
-			continue
+	if *maxFileSize != "" {
+		size, err := parseBytes(*maxFileSize)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --max-file-size: %w", err)
 		}
-		gitPath := fmt.Sprintf("%s/%s/.git", EXTENSIONPATH, ext.Name())
-		if _, err := os.Stat(gitPath); err == nil {
-			validExtensions = append(validExtensions, ext.Name())
+		config.MaxFileSize = size
+	}
+
+	// only vendor changed, so nothing else is even looked at
+	if *vendorOnly {
+		if *upgradeExtensions != "" || *upgradeSkins != "" || *upgradeWorld || *l10n || *fromLock != "" || *rollbackTo != "" || *syncConfig {
+			return nil, fmt.Errorf("--vendor-only can't be combined with --upgrade-extensions, --upgrade-skins, --upgrade-world, --l10n, --from-lock, --rollback-to or --config")
 		}
+		config.UpgradeVendor = true
 	}
 
-	return validExtensions
-}
+	if *sinceCommit != "" && !*onlyChangedRepos {
+		return nil, fmt.Errorf("--since-commit requires --only-changed-repos")
+	}
 
-// get all of the valid skins - in order to be valid, it must exist in the skin path, and be
-// a git repository
-func GetValidSkins() []string {
-	var validSkins []string
-	entries, err := os.ReadDir(SKINPATH)
-	if err != nil {
-		log.Fatal(err)
+	// it's handed to git, where it could otherwise be read as an option
+	if strings.HasPrefix(*sinceCommit, "-") {
+		return nil, fmt.Errorf("invalid --since-commit %s", *sinceCommit)
 	}
 
-	for _, skin := range entries {
-		if !skin.IsDir() {
-			continue
+	if *onlyChangedRepos && (*fromLock != "" || *rollbackTo != "" || *fromArtifacts || *pushOnly != "") {
+		return nil, fmt.Errorf("--only-changed-repos compares against upstream, so can't be combined with --from-lock, --rollback-to, --from-artifacts or --push-only")
+	}
+
+	if *fromLock != "" && *rollbackTo != "" {
+		return nil, fmt.Errorf("--from-lock can't be combined with --rollback-to, they both say exactly what to deploy")
+	}
+
+	// a lock decides exactly what is deployed, so it replaces the usual upgrade flags
+	if *fromLock != "" || *rollbackTo != "" {
+		name, source := "--from-lock", *fromLock
+		if *rollbackTo != "" {
+			name, source = "--rollback-to", *rollbackTo
 		}
 
-		gitPath := fmt.Sprintf("%s/%s/.git", SKINPATH, skin.Name())
-		if _, err := os.Stat(gitPath); err == nil {
-			validSkins = append(validSkins, skin.Name())
+		if *upgradeExtensions != "" || *upgradeSkins != "" || *upgradeVendor || *upgradeWorld {
+			return nil, fmt.Errorf("%s can't be combined with --upgrade-extensions, --upgrade-skins, --upgrade-vendor or --upgrade-world", name)
 		}
-	}
 
-	return validSkins
-}
+		var lock *deployLock
+		var err error
+		if *rollbackTo != "" {
+			lock, err = rollbackLock(source, *recordManifest)
+		} else {
+			lock, err = readDeployLock(source)
+		}
+		if err != nil {
+			return nil, err
+		}
 
-// execute the deploy
-func executeDeploy(config *DeployConfig) error {
-	var exitCodes []int
+		config.Lock = lock
+		config.UpgradeExtensions, config.UpgradeSkins = lock.names()
+		config.UpgradeVendor = lock.Vendor != ""
 
-	if contains(config.Servers, HOSTNAME) {
+		// the messages go back with the code, so the cache built from the newer ones has to go too
+		if *rollbackTo != "" {
+			config.L10n = true
+		}
+	}
 
-		if config.UpgradeVendor {
-			fmt.Println("Updating vendor...")
-			if err := updateVendor(); err != nil {
-				exitCodes = append(exitCodes, 1)
-				if !config.Force {
-					return err
-				}
-			}
+	if *serversMatch != "" {
+		matched, err := matchServers(*serversMatch)
+		if err != nil {
+			return nil, err
 		}
 
-		for _, ext := range config.UpgradeExtensions {
-			fmt.Printf("Updating extension: %s\n", ext)
-			if err := updateExtension(ext); err != nil {
-				exitCodes = append(exitCodes, 1)
-				if !config.Force {
-					return err
-				}
+		for _, server := range matched {
+			if !contains(config.Servers, server) {
+				config.Servers = append(config.Servers, server)
 			}
 		}
+	}
 
-		for _, skin := range config.UpgradeSkins {
-			fmt.Printf("Updating skin: %s\n", skin)
-			if err := updateSkin(skin); err != nil {
-				exitCodes = append(exitCodes, 1)
-				if !config.Force {
-					return err
-				}
+	// applied once every way of picking servers has been expanded, so e.g. --servers all can be narrowed down
+	if *excludeServers != "" {
+		config.ExcludeServers = strings.Split(*excludeServers, ",")
+
+		for _, server := range config.ExcludeServers {
+			if !contains(ALLSERVERS, server) {
+				return nil, fmt.Errorf("unknown server %s in --exclude-servers, expected one of %v", server, ALLSERVERS)
 			}
 		}
 
-		if err := rsyncToLocalProduction(config); err != nil {
-			exitCodes = append(exitCodes, 1)
-			if !config.Force {
-				return err
+		var kept []string
+		for _, server := range config.Servers {
+			if !contains(config.ExcludeServers, server) {
+				kept = append(kept, server)
 			}
 		}
 
-		if config.L10n {
-			fmt.Println("Rebuilding localization cache...")
-			if err := rebuildL10n(config.Lang); err != nil {
-				exitCodes = append(exitCodes, 1)
-				if !config.Force {
-					return err
-				}
-			}
+		if len(config.Servers) > 0 && len(kept) == 0 {
+			return nil, fmt.Errorf("--exclude-servers leaves no servers to deploy to")
 		}
+		config.Servers = kept
 	}
 
-	for _, server := range config.Servers {
-		if server == HOSTNAME {
-			continue
-		}
-		fmt.Printf("Syncing to remote server: %s\n", server)
-		if err := rsyncToRemoteServer(server, config); err != nil {
-			exitCodes = append(exitCodes, 1)
-			if !config.Force {
-				return err
-			}
-		}
+	budget, err := parseBytes(*bandwidthBudget)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --bandwidth-budget: %w", err)
 	}
+	config.BandwidthBudget = budget
 
-	for _, code := range exitCodes {
-		if code != 0 {
-			return fmt.Errorf("deployment completed with errors")
+	// everything past the local work is driven by the server list, so only keeping this server skips all of it
+	if *noRemote {
+		if *pushOnly != "" {
+			return nil, fmt.Errorf("--no-remote can't be combined with --push-only")
 		}
+		config.Servers = []string{HOSTNAME}
 	}
 
-	return nil
-}
+	// --ordered means exactly one thing at a time
+	given := map[string]bool{}
+	deployCmd.Visit(func(f *flag.Flag) {
+		given[f.Name] = true
+	})
+	if config.Ordered {
+		config.MaxParallel = 1
+		config.ComposerParallel = 1
+		given["max-parallel"] = true
+	}
 
-// update vendor
-func updateVendor() error {
-	vendorPath := STAGINGPATH + "/vendor"
+	// the canary goes on its own, then every other remote server at once
+	if *parallelServers {
+		if config.Ordered {
+			return nil, fmt.Errorf("--parallel-servers can't be combined with --ordered")
+		}
 
-	if err := runCommand("git", "-C", vendorPath, "reset", "--hard"); err != nil {
-		return fmt.Errorf("failed to reset vendor: %w", err)
-	}
+		var remotes []string
+		for _, server := range config.Servers {
+			if server != HOSTNAME {
+				remotes = append(remotes, server)
+			}
+		}
+		if len(remotes) == 0 {
+			return nil, fmt.Errorf("--parallel-servers needs a remote server to use as the canary")
+		}
 
-	if err := runCommand("git", "-C", vendorPath, "pull", "--recurse-submodules", "origin", "REL1_43", "--quiet"); err != nil {
-		return fmt.Errorf("failed to pull vendor: %w", err)
+		if config.Canary == "" {
+			config.Canary = remotes[0]
+		}
+		if !given["max-parallel"] {
+			config.MaxParallel = max(len(remotes)-1, 1)
+			given["max-parallel"] = true
+		}
 	}
 
-	cmd := exec.Command("composer", "update", "--no-dev", "--quiet")
-	cmd.Dir = STAGINGPATH
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to run composer update: %w", err)
+	// auto tuning only fills in what wasn't given, so it has to know what was
+	if config.AutoTune {
+		autoTuneTransfers(config, given)
 	}
 
-	return nil
+	return config, nil
 }
 
-// update extensions
-func updateExtension(extension string) error {
-	extPath := fmt.Sprintf("%s/%s", EXTENSIONPATH, extension)
+// pick how many remote servers to sync at once and how much bandwidth each sync may use, so that fanning
+// out to a lot of servers doesn't saturate the network; anything given explicitly is left alone
+func autoTuneTransfers(config *DeployConfig, given map[string]bool) {
+	remotes := 0
+	for _, server := range config.Servers {
+		if server != HOSTNAME {
+			remotes++
+		}
+	}
 
-	if err := runCommand("git", "-C", extPath, "pull", "--recurse-submodules", "--quiet"); err != nil {
-		return fmt.Errorf("failed to update extension %s: %w", extension, err)
+	if !given["max-parallel"] {
+		config.MaxParallel = max(min(remotes, AUTOTUNEMAXPARALLEL), 1)
 	}
 
-	return nil
+	if !given["bwlimit"] && config.BandwidthBudget > 0 {
+		// rsync's --bwlimit is in KiB per second
+		config.BwLimit = fmt.Sprint(max(config.BandwidthBudget/int64(max(config.MaxParallel, 1))/1024, 1))
+	}
 }
 
-// update skins
-func updateSkin(skin string) error {
-	skinPath := fmt.Sprintf("%s/%s", SKINPATH, skin)
+// find every known server whose whole name matches a regex
+func matchServers(pattern string) ([]string, error) {
+	re, err := regexp.Compile("^(?:" + pattern + ")$")
+	if err != nil {
+		return nil, fmt.Errorf("invalid --servers-match: %w", err)
+	}
 
-	if err := runCommand("git", "-C", skinPath, "pull", "--quiet"); err != nil {
-		return fmt.Errorf("failed to update skin %s: %w", skin, err)
+	var matched []string
+	for _, server := range ALLSERVERS {
+		if re.MatchString(server) {
+			matched = append(matched, server)
+		}
 	}
 
-	return nil
-}
+	if len(matched) == 0 {
+		return nil, fmt.Errorf("--servers-match %s doesn't match any of %v", pattern, ALLSERVERS)
+	}
 
-// rsync to the production environment on the same server
-func rsyncToLocalProduction(config *DeployConfig) error {
-	var rsyncArgs []string
+	return matched, nil
+}
 
-	if config.IgnoreTime {
-		rsyncArgs = []string{"--inplace"}
-	} else {
-		rsyncArgs = []string{"--update"}
+// read a list of servers from a file, one per line; blank lines and # comments are ignored
+func readServersFile(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read servers file: %w", err)
 	}
 
-	if config.UpgradeVendor {
-		src := STAGINGPATH + "/vendor/"
-		dst := PRODUCTIONPATH + "/vendor/"
-		if err := runRsync(rsyncArgs, src, dst); err != nil {
-			return err
+	var servers []string
+	for i, line := range strings.Split(string(data), "\n") {
+		line, _, _ = strings.Cut(line, "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
 		}
-	}
 
-	for _, ext := range config.UpgradeExtensions {
-		src := fmt.Sprintf("%s/%s/", EXTENSIONPATH, ext)
-		dst := fmt.Sprintf("%s/extensions/%s/", PRODUCTIONPATH, ext)
-		if err := runRsync(rsyncArgs, src, dst); err != nil {
-			return err
+		if !contains(ALLSERVERS, line) {
+			return nil, fmt.Errorf("unknown server %s on line %d of %s", line, i+1, path)
 		}
-	}
 
-	for _, skin := range config.UpgradeSkins {
-		src := fmt.Sprintf("%s/%s/", SKINPATH, skin)
-		dst := fmt.Sprintf("%s/skins/%s/", PRODUCTIONPATH, skin)
-		if err := runRsync(rsyncArgs, src, dst); err != nil {
-			return err
+		if !contains(servers, line) {
+			servers = append(servers, line)
 		}
 	}
 
-	return nil
+	return servers, nil
 }
 
-// rebuild l10n
-func rebuildL10n(lang string) error {
-	mergeScript := PRODUCTIONPATH + "/extensions/TelepediaMagic/maintenance/mergeMessageFileList.php"
-	cmd := exec.Command("php", mergeScript,
-		"--quiet",
-		"--wiki=metawiki",
-		"--extensions-dir=/prod/mediawiki/extensions:/prod/mediawiki/skins",
-		"--output", PRODUCTIONPATH+"/config/ExtensionMessageFiles.php")
-
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to merge message files: %w", err)
+// reject flag combinations which are ambiguous and warn about ones which are redundant or do nothing.
+// where flags overlap, the broader one wins: --upgrade-world implies --upgrade-vendor, --l10n and
+// --ignore-time and upgrades every extension and skin (narrowed only by --only), --force implies every
+// --continue-on-*-error flag, and --compress implies --compress-servers for every server
+func validateFlagCombinations(config *DeployConfig) error {
+	if config.UpgradeWorld && (len(config.UpgradeExtensions) > 0 || len(config.UpgradeSkins) > 0) {
+		return fmt.Errorf("--upgrade-world already upgrades every extension and skin, use --only to narrow it rather than --upgrade-extensions or --upgrade-skins")
 	}
 
-	rebuildScript := PRODUCTIONPATH + "/maintenance/rebuildLocalisationCache.php"
-	args := []string{rebuildScript, "--quiet", "--wiki=metawiki"}
+	var warnings []string
 
-	if lang != "" {
-		args = append(args, fmt.Sprintf("--lang=%s", lang))
+	if config.UpgradeWorld && config.IgnoreTime {
+		warnings = append(warnings, "--ignore-time is redundant, --upgrade-world already implies it")
 	}
 
-	cmd = exec.Command("php", args...)
-	if err := cmd.Run(); err != nil {
-		return fmt.Errorf("failed to rebuild l10n cache: %w", err)
+	if config.Force && (config.ContinueOnVendor || config.ContinueOnExt || config.ContinueOnSkin || config.ContinueOnL10n || config.ContinueOnServer) {
+		warnings = append(warnings, "the --continue-on-*-error flags are redundant, --force already carries on past every failure")
 	}
 
-	return nil
-}
+	if config.Compress && len(config.CompressServers) > 0 {
+		warnings = append(warnings, "--compress-servers is redundant, --compress already compresses transfers to every server")
+	}
 
-// rsync the changed files to the other servers
-// if we pass --config, we rsync the entire mediawiki install, otherwise, just the specific
-// stuff we asked for
-func rsyncToRemoteServer(server string, config *DeployConfig) error {
-	sshCmd := "ssh -i /prod/mediawiki-staging/deploykey"
+	if config.NoRemote && config.SyncConfig {
+		warnings = append(warnings, "--config only changes what is synced to remote servers, so does nothing with --no-remote")
+	}
+
+	if config.HealthRetries > 0 && !config.HealthCheck && config.Canary == "" {
+		warnings = append(warnings, "--health-check-retries does nothing without --health-check or --canary")
+	}
+
+	if config.Ordered && (config.UpgradeWorld || contains(config.UpgradeExtensions, "all")) {
+		warnings = append(warnings, "--ordered has no given order to follow with every extension, they'll be deployed alphabetically")
+	}
+
+	if config.DryRun && (config.WriteLock != "" || config.RecordManifest != "") {
+		warnings = append(warnings, "--write-lock and --record-manifest do nothing with --dry-run")
+	}
+
+	if config.DryRun && config.MetricsFile != "" {
+		warnings = append(warnings, "--metrics-file does nothing with --dry-run, a dry run isn't a deploy")
+	}
+
+	if config.NoRemote && config.Resumable {
+		warnings = append(warnings, "--resumable only changes syncs to remote servers, so does nothing with --no-remote")
+	}
+
+	if config.FromArtifacts && (config.Lint || config.RefetchTags || config.Shallow) {
+		warnings = append(warnings, "--lint, --refetch-tags and --shallow only apply to pulls, so do nothing for extensions with --from-artifacts")
+	}
+
+	if config.FromArtifacts && config.WriteLock != "" {
+		warnings = append(warnings, "extensions deployed from artifacts have no git sha, so are left out of --write-lock")
+	}
+
+	if config.NoVendorReset && !config.UpgradeVendor {
+		warnings = append(warnings, "--no-vendor-reset does nothing without --upgrade-vendor")
+	}
+
+	if config.NoVendorReset && config.AllowMerge {
+		warnings = append(warnings, "--allow-merge doesn't apply to vendor with --no-vendor-reset, which is only ever fast-forwarded")
+	}
+
+	for _, warning := range warnings {
+		warnf("%s", warning)
+	}
+
+	// only advice, so unlike the warnings above it's not recorded and --strict doesn't fail on it; set
+	// require_deploy_message in the settings to make a message required
+	if !config.DryRun && !REQUIREDEPLOYMESSAGE && strings.TrimSpace(config.Message) == "" {
+		logf("No --message given, please say why you're deploying so it can be traced later\n")
+	}
+
+	// nothing has happened yet, so there's no point starting a deploy which is already going to fail
+	if config.Strict && len(warnings) > 0 {
+		return fmt.Errorf("--strict doesn't allow warnings, %d given about the flags passed", len(warnings))
+	}
+
+	return nil
+}
+
+// validate that what the user asked for is actually valid
+func validateConfig(config *DeployConfig) error {
+	for _, ext := range config.UpgradeExtensions {
+		// an artifact can bring in an extension which isn't in staging yet
+		if config.FromArtifacts && ext != "" && !strings.ContainsAny(ext, "/\\") && !strings.HasPrefix(ext, ".") {
+			continue
+		}
+		if !contains(VALIDEXTENSIONS, ext) {
+			return fmt.Errorf("invalid extension: %s", ext)
+		}
+	}
+
+	if config.FromArtifacts && config.ArtifactURL == "" {
+		return fmt.Errorf("--from-artifacts requires --artifact-url or artifact_url in the settings file")
+	}
+
+	if config.FromArtifacts && config.Lock != nil {
+		return fmt.Errorf("--from-artifacts can't be combined with --from-lock, a lock records git shas")
+	}
+
+	for _, skin := range config.UpgradeSkins {
+		if !contains(VALIDSKINS, skin) {
+			return fmt.Errorf("invalid skin: %s", skin)
+		}
+	}
+
+	if len(config.Only) > 0 && !config.UpgradeWorld {
+		return fmt.Errorf("--only requires --upgrade-world flag")
+	}
+
+	for _, name := range config.Only {
+		if !contains(VALIDEXTENSIONS, name) && !contains(VALIDSKINS, name) {
+			return fmt.Errorf("invalid extension or skin in --only: %s", name)
+		}
+		if contains(VALIDEXTENSIONS, name) && contains(VALIDSKINS, name) {
+			return fmt.Errorf("--only %s is ambiguous, there's both an extension and a skin called that; use --upgrade-extensions or --upgrade-skins instead", name)
+		}
+	}
+
+	// e.g. a skin symlinked into the extensions directory by mistake would otherwise be deployed twice, once
+	// to the wrong place
+	for _, name := range nameCollisions(config.UpgradeExtensions, config.UpgradeSkins) {
+		extPath, extErr := filepath.EvalSymlinks(filepath.Join(EXTENSIONPATH, name))
+		skinPath, skinErr := filepath.EvalSymlinks(filepath.Join(SKINPATH, name))
+		if extErr == nil && skinErr == nil && extPath == skinPath {
+			return fmt.Errorf("extension %s and skin %s are the same directory (%s), one of them is a symlink to the other", name, name, extPath)
+		}
+	}
+
+	if len(config.Servers) == 0 {
+		return fmt.Errorf("at least one server required")
+	}
+
+	// node_exporter's textfile collector only reads files ending in .prom
+	if config.MetricsFile != "" && !strings.HasSuffix(config.MetricsFile, ".prom") {
+		return fmt.Errorf("--metrics-file %s must end in .prom for node_exporter to read it", config.MetricsFile)
+	}
+
+	if config.Releases {
+		switch {
+		case !contains(config.Servers, HOSTNAME):
+			return fmt.Errorf("--releases only changes this server's production, so it has to be one of the servers")
+		case config.IgnoreTime:
+			return fmt.Errorf("--releases can't be combined with --ignore-time (which --upgrade-world implies), in-place updates would change the live release too")
+		case config.Backup:
+			return fmt.Errorf("--releases can't be combined with --backup, the previous releases are kept to switch back to instead")
+		case config.Resume:
+			return fmt.Errorf("--releases can't be combined with --resume, the release an interrupted deploy was building isn't kept")
+		case config.KeepReleases < 2:
+			return fmt.Errorf("--keep-releases must be at least 2, so there's a previous release to switch back to")
+		}
+	}
+
+	if config.SlowWarn < 0 {
+		return fmt.Errorf("invalid --slow-warn %s", config.SlowWarn)
+	}
+
+	if config.Worktree && (config.FromArtifacts || config.ExtensionComposer) {
+		return fmt.Errorf("--worktree can't be combined with --from-artifacts or --extension-composer, which both work in the staging checkout")
+	}
+
+	if config.NotifyFailureOnly && config.NotifyWebhook == "" {
+		return fmt.Errorf("--notify-on-failure-only requires --notify-webhook")
+	}
+
+	if config.NotifyWebhook != "" && !strings.HasPrefix(config.NotifyWebhook, "http://") && !strings.HasPrefix(config.NotifyWebhook, "https://") {
+		// not shown, a webhook URL is usually its own secret
+		return fmt.Errorf("invalid --notify-webhook, expected an http or https URL")
+	}
+
+	if config.Lang != "" && !config.L10n {
+		return fmt.Errorf("--lang requires --l10n flag")
+	}
+
+	if config.ReportFormat != "" && config.ReportFormat != "json" && config.ReportFormat != "junit" {
+		return fmt.Errorf("invalid report format: %s (expected json or junit)", config.ReportFormat)
+	}
+
+	if config.ReportFormat != "" && config.ReportFile == "" && JSONOUTPUT {
+		return fmt.Errorf("--report-format needs --report-file when used with --json, since stdout is already used for the JSON output")
+	}
+
+	if config.PushOnly != "" {
+		if config.PushOnly == HOSTNAME {
+			return fmt.Errorf("--push-only must be a remote server, not this one (%s)", HOSTNAME)
+		}
+		if config.UpgradeWorld || config.L10n {
+			return fmt.Errorf("--push-only doesn't run any local work, so can't be combined with --upgrade-world or --l10n")
+		}
+		if !config.SyncConfig && !config.UpgradeVendor && len(config.UpgradeExtensions) == 0 && len(config.UpgradeSkins) == 0 {
+			return fmt.Errorf("--push-only needs something to push, pass --config, --upgrade-vendor, --upgrade-extensions or --upgrade-skins")
+		}
+	}
+
+	if config.RemoteL10n != REMOTEL10NNONE && config.RemoteL10n != REMOTEL10NREBUILD && config.RemoteL10n != REMOTEL10NSYNC {
+		return fmt.Errorf("invalid --remote-l10n: %s (expected none, rebuild or sync)", config.RemoteL10n)
+	}
+
+	// a dry run doesn't change production, so there's nothing to justify
+	if REQUIREDEPLOYMESSAGE && !config.DryRun && strings.TrimSpace(config.Message) == "" {
+		return fmt.Errorf("every deploy needs a --message saying why it's being done (require_deploy_message is set in the settings file)")
+	}
+
+	if config.L10nScope != L10NSCOPEFULL && config.L10nScope != L10NSCOPEAUTO {
+		return fmt.Errorf("invalid --l10n-scope %s, expected %s or %s", config.L10nScope, L10NSCOPEFULL, L10NSCOPEAUTO)
+	}
+
+	if config.L10nScope == L10NSCOPEAUTO && config.Lang != "" {
+		return fmt.Errorf("--l10n-scope=%s picks the languages itself, so can't be combined with --lang", L10NSCOPEAUTO)
+	}
+
+	if config.RemoteL10n != REMOTEL10NNONE && !config.L10n {
+		return fmt.Errorf("--remote-l10n requires --l10n flag")
+	}
+
+	if config.Atomic && config.IgnoreTime {
+		return fmt.Errorf("--atomic can't be combined with --ignore-time (which --upgrade-world implies), rsync can't delay in-place updates")
+	}
+
+	// an in-place update would write through the hard links into the backup
+	if config.Backup && config.KeepBackups < 1 {
+		return fmt.Errorf("--keep-backups must be at least 1, the backup this deploy takes")
+	}
+
+	if config.Backup && config.IgnoreTime {
+		return fmt.Errorf("--backup can't be combined with --ignore-time (which --upgrade-world implies), in-place updates would change the backup too")
+	}
+
+	if config.WatchErrorLog != "" && config.WatchErrorWindow < time.Second {
+		return fmt.Errorf("--watch-error-window must be at least 1s")
+	}
+
+	if config.SSHPort < 0 || config.SSHPort > 65535 {
+		return fmt.Errorf("invalid --ssh-port: %d", config.SSHPort)
+	}
+
+	if config.ErrorLogThreshold < 1 {
+		return fmt.Errorf("--error-log-threshold must be at least 1")
+	}
+
+	if config.Chmod != "" && !rsyncChmodPattern.MatchString(config.Chmod) {
+		return fmt.Errorf("invalid --chmod %s, expected rsync's format, e.g. D755,F644 or Dg+s,Fo-w", config.Chmod)
+	}
+
+	if config.EncryptedKey != "" && config.SSHAgent {
+		return fmt.Errorf("--encrypted-key can't be combined with --ssh-agent, the first starts an agent of its own")
+	}
+
+	if config.AgeIdentity != "" && config.EncryptedKey == "" {
+		return fmt.Errorf("--age-identity requires --encrypted-key")
+	}
+
+	if filepath.Ext(config.EncryptedKey) == ".age" && config.AgeIdentity == "" {
+		return fmt.Errorf("--age-identity is needed to decrypt %s", config.EncryptedKey)
+	}
+
+	if config.Canary != "" && !contains(config.Servers, config.Canary) {
+		return fmt.Errorf("canary %s must be one of the target servers", config.Canary)
+	}
+
+	return nil
+}
+
+// the names which are both an extension and a skin, sorted
+func nameCollisions(extensions []string, skins []string) []string {
+	var collisions []string
+	for _, name := range extensions {
+		if contains(skins, name) && !contains(collisions, name) {
+			collisions = append(collisions, name)
+		}
+	}
+	sort.Strings(collisions)
+	return collisions
+}
+
+// get all of the valid extensions - in order to be valid, it must exist in the extension path, and be
+// a git repository
+func GetValidExtensions() ([]string, error) {
+	var validExtensions []string
+	entries, err := os.ReadDir(EXTENSIONPATH)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read extension path: %w", err)
+	}
+
+	for _, ext := range entries {
+		if !ext.IsDir() {
+			continue
+		}
+		gitPath := fmt.Sprintf("%s/%s/.git", EXTENSIONPATH, ext.Name())
+		if _, err := os.Stat(gitPath); err == nil {
+			validExtensions = append(validExtensions, ext.Name())
+		}
+	}
+
+	return validExtensions, nil
+}
+
+// get all of the valid skins - in order to be valid, it must exist in the skin path, and be
+// a git repository
+func GetValidSkins() ([]string, error) {
+	var validSkins []string
+	entries, err := os.ReadDir(SKINPATH)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read skin path: %w", err)
+	}
+
+	for _, skin := range entries {
+		if !skin.IsDir() {
+			continue
+		}
+
+		gitPath := fmt.Sprintf("%s/%s/.git", SKINPATH, skin.Name())
+		if _, err := os.Stat(gitPath); err == nil {
+			validSkins = append(validSkins, skin.Name())
+		}
+	}
+
+	return validSkins, nil
+}
+
+// execute the deploy, recording the outcome of every step against the server it ran on
+func executeDeploy(config *DeployConfig) (results []*ServerResult, err error) {
+	results = newServerResults(config.Servers)
+
+	// failures which were let through by --force or a --continue-on-*-error flag, along with which flag it
+	// was; these are listed however the deploy ends, since otherwise they're easy to miss in the output
+	var tolerated []string
+
+	// sent however the deploy ends, even if the pre hook stops it, since a failure is what most needs to be
+	// heard about
+	if config.NotifyWebhook != "" && !config.DryRun {
+		defer func() {
+			sendDeployNotification(config, err, tolerated)
+		}()
+	}
+
+	if config.PreDeployHook != "" && !config.DryRun {
+		logf("Running pre-deploy hook: %s\n", config.PreDeployHook)
+		if err := runHook(config.PreDeployHook, hookEnv(config)); err != nil {
+			return results, err
+		}
+	}
+
+	// the post hook has to run however the deploy ends, e.g. to re-enable alerting
+	if config.PostDeployHook != "" && !config.DryRun {
+		defer func() {
+			runPostDeployHook(config, err)
+		}()
+	}
+
+	state := loadDeployState(config)
+
+	// only once everything has been synced from them, whichever way the deploy ends
+	if config.Worktree {
+		defer removeWorktrees(config)
+	}
+
+	if config.Releases {
+		defer discardRelease(config)
+	}
+
+	carryOn := func(class string, step string, err error) bool {
+		flagName := config.toleratingFlag(class)
+		if flagName != "" {
+			tolerated = append(tolerated, fmt.Sprintf("%s (%s): %v", step, flagName, err))
+		}
+		return flagName != ""
+	}
+	defer func() {
+		if len(tolerated) > 0 {
+			logf("The following steps failed but were forced through:\n")
+			for _, t := range tolerated {
+				logf("  - %s\n", t)
+			}
+		}
+	}()
+
+	// registered after the post hook and notification, so they and the deploy log see the deploy fail
+	if config.Strict {
+		defer func() {
+			if err == nil && (warningCount() > 0 || len(tolerated) > 0) {
+				err = fmt.Errorf("--strict doesn't allow warnings or failures let through by other flags, but there were %d warnings and %d such failures", warningCount(), len(tolerated))
+			}
+		}()
+	}
+
+	// run a single step of the deploy unless we're resuming a deploy which already completed it
+	runStep := func(r *ServerResult, step string, fn func() error) error {
+		key := r.Server + ":" + step
+		if state.isCompleted(key) {
+			logf("Skipping %s on %s, already completed\n", step, r.Server)
+			r.skip(step, "already completed")
+			return nil
+		}
+
+		DASHBOARD.set(r.Server, step, "running")
+		stop := func() {}
+		if config.SlowWarn > 0 {
+			stop = watchSlowStep(r.Server, step, config.SlowWarn)
+		}
+		start := time.Now()
+		err := withExitCode(stepExitCode(step), fn())
+		stop()
+		r.recordTimed(step, err, time.Since(start))
+		if err != nil {
+			return err
+		}
+
+		if isUpdateStep(key) {
+			state.invalidateSyncs()
+		}
+		state.complete(key)
+		return nil
+	}
+
+	// the deploy hooks of each upgraded extension which declares any, read once it's pulled and run once
+	// every server has it
+	extensionHooks := map[string][]extensionDeployHook{}
+
+	if contains(config.Servers, HOSTNAME) {
+		local := resultFor(results, HOSTNAME)
+
+		if config.AbortOnDirty {
+			dirty, err := findDirtyRepos(config)
+			if err == nil && len(dirty) > 0 {
+				err = fmt.Errorf("refusing to deploy from a dirty staging tree, uncommitted or untracked changes in: %s (use --allow-dirty to override)", strings.Join(dirty, ", "))
+			}
+			if err != nil {
+				local.record("dirty-check", err)
+				return results, withExitCode(EXITGIT, err)
+			}
+		}
+
+		if config.MaxStagingAge > 0 {
+			stale, err := findStaleRepos(config)
+			if err == nil && len(stale) > 0 {
+				if config.Force {
+					warnf("these repos haven't been fetched in over %s: %s", config.MaxStagingAge, strings.Join(stale, ", "))
+				} else {
+					err = fmt.Errorf("these repos haven't been fetched in over %s (use --force to deploy anyway): %s", config.MaxStagingAge, strings.Join(stale, ", "))
+				}
+			}
+			if err != nil {
+				local.record("staging-age-check", err)
+				return results, withExitCode(EXITGIT, err)
+			}
+		}
+
+		// two maintenance scripts writing the same tables or cache at once can leave either half done
+		if config.L10n || (len(config.UpgradeExtensions) > 0 && config.ExtensionHooks) {
+			running, err := findRunningMaintenance(config.IgnoreMaintenance)
+			if err == nil && len(running) > 0 {
+				if config.Force {
+					warnf("these maintenance scripts are already running: %s", strings.Join(running, ", "))
+				} else {
+					err = fmt.Errorf("refusing to deploy while maintenance scripts are already running (use --ignore-running-maintenance to allow them, or --force to deploy anyway): %s", strings.Join(running, ", "))
+				}
+			}
+			if err != nil {
+				local.record("maintenance-check", err)
+				return results, withExitCode(EXITGIT, err)
+			}
+		}
+
+		if config.UpgradeVendor {
+			err := runStep(local, "vendor", func() error {
+				logf("Updating vendor...\n")
+				return updateVendor(config)
+			})
+			if err != nil && !carryOn("vendor", "vendor", err) {
+				return results, err
+			}
+		}
+
+		for _, ext := range config.UpgradeExtensions {
+			err := runStep(local, "extension:"+ext, func() error {
+				logf("Updating extension: %s\n", ext)
+				return updateExtension(ext, config)
+			})
+			if err != nil && !carryOn("extension", "extension:"+ext, err) {
+				return results, err
+			}
+
+			// checked now, so a hook which isn't allowed stops the deploy before it reaches any server
+			if err == nil && config.ExtensionHooks {
+				hooks, err := extensionDeployHooks(ext, config)
+				if err != nil {
+					local.record("hooks:"+ext, err)
+					if !carryOn("extension", "hooks:"+ext, err) {
+						return results, err
+					}
+				}
+				if len(hooks) > 0 {
+					extensionHooks[ext] = hooks
+				}
+			} else if err == nil {
+				// so whoever's deploying knows there's something they may still need to run
+				if hooks, _ := extensionDeployHooks(ext, config); len(hooks) > 0 {
+					logf("%s declares %d deploy hooks, which aren't run without --extension-hooks\n", ext, len(hooks))
+				}
+			}
+		}
+
+		// every extension's dependencies are in its own directory, so they can be installed at once; an
+		// extension which failed to update is left as it was
+		if config.ExtensionComposer {
+			var pending []string
+			for _, ext := range config.UpgradeExtensions {
+				if hasComposerJSON(ext) && !local.stepFailed("extension:"+ext) && !state.isCompleted(HOSTNAME+":composer:"+ext) {
+					pending = append(pending, ext)
+				}
+			}
+
+			installed := map[string]error{}
+			for _, result := range installExtensionDependencies(pending, config.ComposerParallel) {
+				installed[result.Extension] = result.Err
+			}
+
+			for _, ext := range config.UpgradeExtensions {
+				if !hasComposerJSON(ext) || local.stepFailed("extension:"+ext) {
+					continue
+				}
+
+				err := runStep(local, "composer:"+ext, func() error {
+					return installed[ext]
+				})
+				if err != nil && !carryOn("extension", "composer:"+ext, err) {
+					return results, err
+				}
+			}
+		}
+
+		for _, skin := range config.UpgradeSkins {
+			err := runStep(local, "skin:"+skin, func() error {
+				logf("Updating skin: %s\n", skin)
+				return updateSkin(skin, config)
+			})
+			if err != nil && !carryOn("skin", "skin:"+skin, err) {
+				return results, err
+			}
+		}
+
+		// checked once everything is pulled, since it's the new files we're worried about
+		if config.MaxFileSize > 0 {
+			large, err := findLargeFiles(config)
+			if err == nil && len(large) > 0 {
+				if config.Force {
+					warnf("these files are bigger than %s: %s", formatBytes(config.MaxFileSize), strings.Join(large, ", "))
+				} else {
+					err = fmt.Errorf("refusing to sync files bigger than %s (use --force to sync them anyway): %s", formatBytes(config.MaxFileSize), strings.Join(large, ", "))
+				}
+			}
+			if err != nil {
+				local.record("file-size-check", err)
+				return results, err
+			}
+		}
+
+		if config.Backup {
+			err := runStep(local, "backup", func() error {
+				backupPath, err := createBackup(config)
+				if err != nil {
+					return err
+				}
+				logf("Backed up production to %s\n", backupPath)
+
+				// a failed prune leaves more backups than wanted, which isn't a reason to stop the deploy
+				if !DRYRUN {
+					if err := pruneBackups(config.KeepBackups); err != nil {
+						logf("Failed to remove old backups: %v\n", err)
+					}
+				}
+				return nil
+			})
+			if err != nil && !carryOn("backup", "backup", err) {
+				return results, err
+			}
+		}
+
+		// a release which can't be made can't be fallen back from, since that'd mean syncing into the live one
+		if config.Releases {
+			err := runStep(local, "release", func() error {
+				return prepareRelease(config)
+			})
+			if err != nil {
+				return results, err
+			}
+		}
+
+		err := runStep(local, "rsync-local", func() error {
+			return rsyncToLocalProduction(config)
+		})
+		if err != nil && !carryOn("rsync", "rsync-local", err) {
+			return results, err
+		}
+
+		if config.L10n {
+			err := runStep(local, "l10n", func() error {
+				logf("Rebuilding localization cache...\n")
+				return rebuildL10n(config)
+			})
+			if err != nil && !carryOn("l10n", "l10n", err) {
+				return results, err
+			}
+		}
+
+		// remote servers are synced from production, so they get the new release too once it's live
+		if config.release != "" {
+			// the remote servers would be synced from the old release and reported as deployed, so this
+			// stops the deploy even when --force or --continue-on-l10n-error let the failure through
+			if local.stepFailed("rsync-local") || local.stepFailed("l10n") {
+				return results, fmt.Errorf("release %s wasn't fully built, leaving %s live and not syncing any other servers", config.release, PRODUCTIONPATH)
+			}
+
+			err := runStep(local, "activate-release", func() error {
+				if err := activateRelease(config.release); err != nil {
+					return err
+				}
+				logf("Switched %s to release %s\n", PRODUCTIONPATH, config.release)
+				return nil
+			})
+			if err != nil {
+				return results, err
+			}
+
+			if err := pruneReleases(config.KeepReleases); err != nil {
+				logf("Failed to remove old releases: %v\n", err)
+			}
+		}
+	}
+
+	// with a canary, deploy to it first and make sure it is healthy before touching anything else;
+	// a failing canary always stops the deploy, even with --force, since that is the whole point
+	if config.Canary != "" {
+		canary := resultFor(results, config.Canary)
+		canary.Canary = true
+
+		if config.Canary != HOSTNAME {
+			err := runStep(canary, "sync", func() error {
+				logf("Syncing to canary server: %s\n", config.Canary)
+				return rsyncToRemoteServer(config.Canary, config)
+			})
+			if err != nil {
+				return results, fmt.Errorf("canary %s failed, aborting deploy: %w", config.Canary, err)
+			}
+
+			if config.RemoteL10n != REMOTEL10NNONE && localL10nFailed(results) {
+				canary.skip("l10n", "local l10n failed")
+			} else if config.RemoteL10n != REMOTEL10NNONE {
+				err := runStep(canary, "l10n", func() error {
+					return updateRemoteL10n(config.Canary, config)
+				})
+				if err != nil {
+					return results, fmt.Errorf("canary %s failed, aborting deploy: %w", config.Canary, err)
+				}
+			}
+		}
+
+		logf("Health checking canary server: %s\n", config.Canary)
+		var err error
+		if !config.DryRun {
+			err = checkHealthWithRetries(config.Canary, config.HealthCheckURL, config.HealthRetries).Err
+		}
+		canary.record("health-check", err)
+		if err != nil {
+			return results, fmt.Errorf("canary %s is unhealthy, aborting deploy: %w", config.Canary, err)
+		}
+	}
+
+	var remotes []string
+	for _, server := range config.Servers {
+		if server != HOSTNAME && server != config.Canary {
+			remotes = append(remotes, server)
+		}
+	}
+
+	if config.Canary != "" && len(remotes) > 0 {
+		logf("Canary %s passed, syncing the remaining %d servers %d at a time\n", config.Canary, len(remotes), min(max(config.MaxParallel, 1), len(remotes)))
+	}
+
+	syncServer := func(server string) error {
+		if config.OnlyChanged && !config.DryRun {
+			changed, err := remoteHasChanges(server, config)
+			if err != nil {
+				logf("Couldn't check whether %s is already in sync, syncing anyway: %v\n", server, err)
+			} else if !changed {
+				logf("Skipping %s, it's already in sync\n", server)
+				resultFor(results, server).skip("sync", "already in sync")
+				return nil
+			}
+		}
+
+		err := runStep(resultFor(results, server), "sync", func() error {
+			logf("Syncing to remote server: %s\n", server)
+			return rsyncToRemoteServer(server, config)
+		})
+		if err != nil || config.RemoteL10n == REMOTEL10NNONE {
+			return err
+		}
+
+		if localL10nFailed(results) {
+			resultFor(results, server).skip("l10n", "local l10n failed")
+			return nil
+		}
+
+		// the new code is already live by now, so its messages should follow as soon as possible
+		return runStep(resultFor(results, server), "l10n", func() error {
+			return updateRemoteL10n(server, config)
+		})
+	}
+
+	// with --max-parallel several servers are synced at once; once one fails (and that isn't tolerated)
+	// no more are started, but the ones already syncing are left to finish
+	syncErrs := make([]error, len(remotes))
+	sem := make(chan struct{}, max(config.MaxParallel, 1))
+	var wg sync.WaitGroup
+	var stopped atomic.Bool
+
+	for i, server := range remotes {
+		sem <- struct{}{}
+		if stopped.Load() {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			syncErrs[i] = syncServer(server)
+			if syncErrs[i] != nil && config.toleratingFlag("server") == "" {
+				stopped.Store(true)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for i, err := range syncErrs {
+		if err != nil && !carryOn("server", "sync:"+remotes[i], err) {
+			return results, err
+		}
+	}
+
+	for _, ext := range config.UpgradeExtensions {
+		hooks := extensionHooks[ext]
+		if len(hooks) == 0 {
+			continue
+		}
+
+		err := runStep(resultFor(results, HOSTNAME), "hooks:"+ext, func() error {
+			return runExtensionDeployHooks(ext, hooks, config)
+		})
+		if err != nil && !carryOn("extension", "hooks:"+ext, err) {
+			return results, err
+		}
+	}
+
+	// the canary was already checked, and a server which failed to sync is already known to be broken
+	if config.HealthCheck && !config.DryRun {
+		var toCheck []string
+		for _, r := range results {
+			if r.Server != config.Canary && !r.Failed() {
+				toCheck = append(toCheck, r.Server)
+			}
+		}
+
+		logf("Health checking servers: %v\n", toCheck)
+		health := checkServersHealth(toCheck, config.HealthCheckURL, config.HealthRetries, config.HealthParallel)
+		for _, h := range health {
+			resultFor(results, h.Server).record("health-check", h.Err)
+		}
+		printHealthResults(health)
+	}
+
+	if config.WatchErrorLog != "" && !config.DryRun {
+		logf("Watching %s on every server for %s...\n", config.WatchErrorLog, config.WatchErrorWindow)
+
+		spiked := false
+		for _, watched := range watchErrorLogs(config.Servers, config.WatchErrorLog, config.WatchErrorWindow) {
+			err := watched.Err
+			if err == nil && len(watched.Lines) >= config.ErrorLogThreshold {
+				err = fmt.Errorf("%d new errors in %s", len(watched.Lines), config.WatchErrorLog)
+				spiked = true
+			}
+			resultFor(results, watched.Server).record("error-log", err)
+
+			for _, line := range watched.Lines {
+				if mentionsDeployed(line, config) {
+					logf("  -> [%s] (deployed) %s\n", watched.Server, line)
+				} else {
+					logf("  -> [%s] %s\n", watched.Server, line)
+				}
+			}
+		}
+
+		if spiked && config.Backup {
+			logf("Errors spiked after the deploy, consider rolling back with utils rollback\n")
+		} else if spiked {
+			logf("Errors spiked after the deploy, consider rolling back to the previously deployed versions\n")
+		}
+	}
+
+	if config.WarmCache && !config.DryRun {
+		logf("Warming caches...\n")
+		warmCaches(config.Servers, config.WarmCacheURLs)
+	}
+
+	if countFailedServers(results) > 0 {
+		return results, fmt.Errorf("deployment completed with errors")
+	}
+
+	state.clear()
+	return results, nil
+}
+
+// find all of the repos we are about to upgrade which have uncommitted or untracked changes
+func findDirtyRepos(config *DeployConfig) ([]string, error) {
+	var dirty []string
+
+	// artifacts replace the whole extension, so there's nothing in it to lose, and a worktree doesn't
+	// touch the staging checkout at all
+	extensions, skins := config.UpgradeExtensions, config.UpgradeSkins
+	if config.FromArtifacts || config.Worktree {
+		extensions = nil
+	}
+	if config.Worktree {
+		skins = nil
+	}
+
+	for _, ext := range extensions {
+		extPath := fmt.Sprintf("%s/%s", EXTENSIONPATH, ext)
+		isDirty, err := isRepoDirty(extPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check status of extension %s: %w", ext, err)
+		}
+		if isDirty {
+			dirty = append(dirty, "extensions/"+ext)
+		}
+	}
+
+	for _, skin := range skins {
+		skinPath := fmt.Sprintf("%s/%s", SKINPATH, skin)
+		isDirty, err := isRepoDirty(skinPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check status of skin %s: %w", skin, err)
+		}
+		if isDirty {
+			dirty = append(dirty, "skins/"+skin)
+		}
+	}
+
+	return dirty, nil
+}
+
+// find all of the repos we are about to upgrade which were last fetched longer ago than --max-staging-age
+func findStaleRepos(config *DeployConfig) ([]string, error) {
+	repos := map[string]string{}
+	var names []string
+
+	if config.UpgradeVendor {
+		names = append(names, "vendor")
+		repos["vendor"] = STAGINGPATH + "/vendor"
+	}
+	// artifacts are built by CI, not fetched here
+	extensions := config.UpgradeExtensions
+	if config.FromArtifacts {
+		extensions = nil
+	}
+	for _, ext := range extensions {
+		names = append(names, "extensions/"+ext)
+		repos["extensions/"+ext] = fmt.Sprintf("%s/%s", EXTENSIONPATH, ext)
+	}
+	for _, skin := range config.UpgradeSkins {
+		names = append(names, "skins/"+skin)
+		repos["skins/"+skin] = fmt.Sprintf("%s/%s", SKINPATH, skin)
+	}
+
+	var stale []string
+	for _, name := range names {
+		age, err := lastFetchAge(repos[name])
+		if err != nil {
+			return nil, fmt.Errorf("failed to check when %s was last fetched: %w", name, err)
+		}
+
+		if age < 0 {
+			stale = append(stale, name+" (never fetched)")
+		} else if age > config.MaxStagingAge {
+			stale = append(stale, fmt.Sprintf("%s (%s ago)", name, age.Round(time.Minute)))
+		}
+	}
+
+	return stale, nil
+}
+
+// how long ago a repo was last fetched, going by the mtime of FETCH_HEAD, or -1 if it never has been
+func lastFetchAge(repoPath string) (time.Duration, error) {
+	fetchHead, err := gitOutput(repoPath, "rev-parse", "--git-path", "FETCH_HEAD")
+	if err != nil {
+		return 0, err
+	}
+
+	if !strings.HasPrefix(fetchHead, "/") {
+		fetchHead = repoPath + "/" + fetchHead
+	}
+
+	info, err := os.Stat(fetchHead)
+	if errors.Is(err, os.ErrNotExist) {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return time.Since(info.ModTime()), nil
+}
+
+// the maintenance scripts which are left running during a deploy unless --ignore-running-maintenance says
+// otherwise; job runners are nearly always running on an app server
+const DEFAULTIGNOREDMAINTENANCE = "runJobs.php"
+
+// find every MediaWiki maintenance script already running on this server apart from those ignored, as
+// pid (command line); pgrep not being installed isn't a reason to stop a deploy, so that's only a warning
+func findRunningMaintenance(ignored []string) ([]string, error) {
+	// anchored to the program itself being php, e.g. php or /usr/bin/php8.2, so that anything which only
+	// mentions a maintenance script, like a shell or an editor, isn't mistaken for one
+	cmd := exec.Command("pgrep", "-a", "-f", "^([^ ]*/)?php[0-9.]* ([^ ]* )*[^ ]*maintenance/")
+	out, err := cmd.Output()
+
+	var exitErr *exec.ExitError
+	switch {
+	// pgrep exits 1 when nothing matched
+	case errors.As(err, &exitErr) && exitErr.ExitCode() == 1:
+		return nil, nil
+	case errors.Is(err, exec.ErrNotFound):
+		warnf("can't check for running maintenance scripts, pgrep isn't installed")
+		return nil, nil
+	case err != nil:
+		return nil, fmt.Errorf("failed to check for running maintenance scripts: %w", err)
+	}
+
+	var running []string
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		pid, command, _ := strings.Cut(line, " ")
+		if isIgnoredMaintenance(command, ignored) {
+			continue
+		}
+		running = append(running, fmt.Sprintf("%s (%s)", pid, command))
+	}
+
+	return running, nil
+}
+
+// whether a maintenance script's command line runs one of the ignored scripts, given either directly
+// (php maintenance/runJobs.php) or through run.php (php maintenance/run.php runJobs), with or without .php
+func isIgnoredMaintenance(command string, ignored []string) bool {
+	args := strings.Fields(command)
+	for i, arg := range args {
+		if !strings.Contains(arg, "maintenance/") {
+			continue
+		}
+
+		script := filepath.Base(arg)
+		if script == "run.php" && i+1 < len(args) {
+			script = args[i+1]
+		}
+		script = strings.TrimSuffix(script, ".php")
+
+		for _, name := range ignored {
+			if strings.TrimSuffix(strings.TrimSpace(name), ".php") == script {
+				return true
+			}
+		}
+		return false
+	}
+
+	return false
+}
+
+// find every file about to be synced from staging which is bigger than --max-file-size, skipping the
+// dotfiles rsync won't sync
+func findLargeFiles(config *DeployConfig) ([]string, error) {
+	var dirs []string
+	if config.UpgradeVendor {
+		dirs = append(dirs, STAGINGPATH+"/vendor")
+	}
+	for _, ext := range config.UpgradeExtensions {
+		dirs = append(dirs, config.sourcePath(fmt.Sprintf("%s/%s", EXTENSIONPATH, ext)))
+	}
+	for _, skin := range config.UpgradeSkins {
+		dirs = append(dirs, config.sourcePath(fmt.Sprintf("%s/%s", SKINPATH, skin)))
+	}
+
+	var large []string
+	for _, dir := range dirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+
+			if path != dir && strings.HasPrefix(d.Name(), ".") && !matchesAny(config.Include, d.Name()) {
+				if d.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if d.IsDir() {
+				return nil
+			}
+
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() > config.MaxFileSize {
+				large = append(large, fmt.Sprintf("%s (%s)", strings.TrimPrefix(path, STAGINGPATH+"/"), formatBytes(info.Size())))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to check file sizes in %s: %w", dir, err)
+		}
+	}
+
+	return large, nil
+}
+
+// a repo is dirty if git status reports anything at all, including untracked files
+func isRepoDirty(repoPath string) (bool, error) {
+	status, err := gitOutput(repoPath, "status", "--porcelain")
+	if err != nil {
+		return false, err
+	}
+
+	return status != "", nil
+}
+
+// update vendor
+func updateVendor(config *DeployConfig) error {
+	vendorPath := STAGINGPATH + "/vendor"
+
+	if config.RefetchTags {
+		if err := refetchTags(vendorPath); err != nil {
+			return err
+		}
+	}
+
+	// a locked vendor is exactly what was deployed before, so composer mustn't change it
+	if config.Lock != nil {
+		return checkoutLocked(vendorPath, config.Lock.Vendor)
+	}
+
+	// the reset below throws away local changes, which is occasionally a hand-made emergency patch,
+	// so don't do it silently
+	changes, err := gitOutput(vendorPath, "status", "--porcelain")
+	if err != nil {
+		return fmt.Errorf("failed to check vendor status: %w", err)
+	}
+
+	// someone is working in vendor, so only ever move it forward and never lose what they've done
+	if config.NoVendorReset {
+		if changes != "" {
+			return fmt.Errorf("vendor has local changes, commit or stash them before pulling with --no-vendor-reset:\n%s", changes)
+		}
+
+		if err := pullRepo(vendorPath, "--ff-only", "--recurse-submodules", "origin", "REL1_43", "--quiet"); err != nil {
+			return fmt.Errorf("failed to pull vendor: %w", err)
+		}
+
+		return composerUpdate()
+	}
+
+	if changes != "" {
+		if !config.Force {
+			return fmt.Errorf("vendor has local changes which would be lost by the reset (use --force to discard them):\n%s", changes)
+		}
+		logf("Discarding local vendor changes:\n%s\n", changes)
+	}
+
+	if err := runCommand("git", "-C", vendorPath, "reset", "--hard"); err != nil {
+		return fmt.Errorf("failed to reset vendor: %w", err)
+	}
+
+	if err := pullRepo(vendorPath, append(pullArgs(config), "--recurse-submodules", "origin", "REL1_43", "--quiet")...); err != nil {
+		return fmt.Errorf("failed to pull vendor: %w", err)
+	}
+
+	return composerUpdate()
+}
+
+// bring vendor in line with composer.json once it has been pulled
+func composerUpdate() error {
+	if err := runCommandIn(STAGINGPATH, COMPOSERBIN, "update", "--no-dev", "--quiet"); err != nil {
+		return fmt.Errorf("failed to run composer update: %w", err)
+	}
+
+	return nil
+}
+
+// update extensions
+func updateExtension(extension string, config *DeployConfig) error {
+	extPath := fmt.Sprintf("%s/%s", EXTENSIONPATH, extension)
 
-	baseArgs := []string{"-e", sshCmd}
+	if config.RefetchTags {
+		if err := refetchTags(extPath); err != nil {
+			return err
+		}
+	}
 
-	if config.IgnoreTime {
-		baseArgs = append(baseArgs, "--inplace")
-	} else {
-		baseArgs = append(baseArgs, "--update")
+	if config.Worktree {
+		return checkoutWorktree(extPath, "extensions", config)
 	}
 
-	if config.SyncConfig {
-		src := PRODUCTIONPATH + "/"
-		dst := fmt.Sprintf("%s@%s:%s/", DEPLOYUSER, server, PRODUCTIONPATH)
-		fmt.Printf("  -> [CONFIG] Syncing entire MediaWiki root to %s...\n", server)
-		return runRsync(baseArgs, src, dst)
+	if config.Lock != nil {
+		return checkoutLocked(extPath, config.Lock.Extensions[extension])
+	}
+
+	if config.FromArtifacts {
+		return updateExtensionFromArtifact(extension, config)
+	}
+
+	args := append(pullArgs(config), "--recurse-submodules", "--quiet")
+
+	// lint and --l10n-scope only have to look at what the pull brings in
+	var before string
+	if config.Lint || config.L10nScope == L10NSCOPEAUTO {
+		var err error
+		if before, err = gitOutput(extPath, "rev-parse", "HEAD"); err != nil {
+			return fmt.Errorf("failed to get HEAD of extension %s: %w", extension, err)
+		}
+	}
+
+	pull := pullRepo
+	if config.Shallow {
+		pull = pullShallow
+	}
+	if err := pull(extPath, args...); err != nil {
+		return fmt.Errorf("failed to update extension %s: %w", extension, err)
+	}
+
+	if config.Lint {
+		if err := lintPulled(extPath, before); err != nil {
+			return err
+		}
+	}
+
+	if before != "" {
+		config.pullFrom(extPath, before)
+	}
+
+	return nil
+}
+
+// update skins
+func updateSkin(skin string, config *DeployConfig) error {
+	skinPath := fmt.Sprintf("%s/%s", SKINPATH, skin)
+
+	if config.RefetchTags {
+		if err := refetchTags(skinPath); err != nil {
+			return err
+		}
+	}
+
+	if config.Worktree {
+		return checkoutWorktree(skinPath, "skins", config)
+	}
+
+	if config.Lock != nil {
+		return checkoutLocked(skinPath, config.Lock.Skins[skin])
+	}
+
+	args := append(pullArgs(config), "--quiet")
+
+	// lint and --l10n-scope only have to look at what the pull brings in
+	var before string
+	if config.Lint || config.L10nScope == L10NSCOPEAUTO {
+		var err error
+		if before, err = gitOutput(skinPath, "rev-parse", "HEAD"); err != nil {
+			return fmt.Errorf("failed to get HEAD of skin %s: %w", skin, err)
+		}
+	}
+
+	pull := pullRepo
+	if config.Shallow {
+		pull = pullShallow
+	}
+	if err := pull(skinPath, args...); err != nil {
+		return fmt.Errorf("failed to update skin %s: %w", skin, err)
+	}
+
+	if config.Lint {
+		if err := lintPulled(skinPath, before); err != nil {
+			return err
+		}
+	}
+
+	if before != "" {
+		config.pullFrom(skinPath, before)
+	}
+
+	return nil
+}
+
+// the args every pull starts with; by default only fast-forwards are allowed so that staging stays a clean
+// mirror of upstream and divergence is an error rather than a merge commit
+func pullArgs(config *DeployConfig) []string {
+	if config.AllowMerge {
+		return []string{}
+	}
+
+	return []string{"--ff-only"}
+}
+
+// fetch every tag of a repo; a plain fetch doesn't pick up new tags on commits it already has, and never
+// moves a tag which was re-pointed upstream, which --force does
+func refetchTags(repoPath string) error {
+	if err := runCommand("git", "-C", repoPath, "fetch", "--tags", "--force", "--quiet", "origin"); err != nil {
+		return fmt.Errorf("failed to fetch tags of %s: %w", repoPath, err)
+	}
+
+	return nil
+}
+
+// pull a repo, turning the opaque "exit status 1" of a pull that can't be applied into a clear error
+func pullRepo(repoPath string, args ...string) error {
+	pullErr := runCommand("git", append([]string{"-C", repoPath, "pull"}, args...)...)
+	if pullErr == nil {
+		return nil
 	}
 
+	// a conflicted merge leaves the repo half merged, so put it back how it was before
+	conflicted, err := gitOutput(repoPath, "diff", "--name-only", "--diff-filter=U")
+	if err == nil && conflicted != "" {
+		if err := runCommand("git", "-C", repoPath, "merge", "--abort"); err != nil {
+			return fmt.Errorf("%w in %s (aborting the merge also failed: %v), resolve it manually: %s", ErrMergeConflict, repoPath, err, strings.ReplaceAll(conflicted, "\n", ", "))
+		}
+		return fmt.Errorf("%w in %s, the merge was aborted, resolve it manually: %s", ErrMergeConflict, repoPath, strings.ReplaceAll(conflicted, "\n", ", "))
+	}
+
+	ahead, aheadErr := gitOutput(repoPath, "rev-list", "--count", "@{u}..HEAD")
+	behind, behindErr := gitOutput(repoPath, "rev-list", "--count", "HEAD..@{u}")
+	if aheadErr == nil && behindErr == nil && ahead != "0" && behind != "0" {
+		return fmt.Errorf("%w in %s (%s local and %s upstream commits), resolve it manually", ErrDiverged, repoPath, ahead, behind)
+	}
+
+	return pullErr
+}
+
+// update a repo for --shallow. A full clone is pulled as usual, since fetching it with --depth would make
+// it shallow for good and a depth limited pull can't fast-forward anyway. A shallow clone only fetches the
+// latest commit of its upstream branch and is reset to it, as its history is too short to fast-forward
+// along; it's unshallowed if that still leaves the upstream commit missing
+func pullShallow(repoPath string, args ...string) error {
+	shallow, err := isShallowRepo(repoPath)
+	if err != nil {
+		return err
+	}
+	if !shallow {
+		return pullRepo(repoPath, args...)
+	}
+
+	upstream, err := gitOutput(repoPath, "rev-parse", "--abbrev-ref", "--symbolic-full-name", "@{u}")
+	if err != nil {
+		return fmt.Errorf("failed to find the upstream branch of %s: %w", repoPath, err)
+	}
+	remote, branch, ok := strings.Cut(upstream, "/")
+	if !ok {
+		return fmt.Errorf("upstream %s of %s isn't a remote branch", upstream, repoPath)
+	}
+
+	// a reset would throw away anything committed in staging, which a pull would have refused to
+	if ahead, err := gitOutput(repoPath, "rev-list", "--count", "@{u}..HEAD"); err != nil || ahead != "0" {
+		return fmt.Errorf("%w in %s (%s local commits), a shallow update would discard them, resolve it manually", ErrDiverged, repoPath, ahead)
+	}
+
+	if err := runCommand("git", "-C", repoPath, "fetch", "--quiet", "--depth=1", remote, branch); err != nil {
+		return fmt.Errorf("failed to fetch %s of %s: %w", upstream, repoPath, err)
+	}
+	if _, err := gitOutput(repoPath, "rev-parse", "--verify", "--quiet", "@{u}^{commit}"); err != nil {
+		if err := runCommand("git", "-C", repoPath, "fetch", "--quiet", "--unshallow", remote); err != nil {
+			return fmt.Errorf("failed to unshallow %s: %w", repoPath, err)
+		}
+	}
+
+	if err := runCommand("git", "-C", repoPath, "reset", "--quiet", "--hard", "@{u}"); err != nil {
+		return fmt.Errorf("failed to reset %s to %s: %w", repoPath, upstream, err)
+	}
+	if contains(args, "--recurse-submodules") {
+		if err := runCommand("git", "-C", repoPath, "submodule", "update", "--init", "--recursive", "--quiet"); err != nil {
+			return fmt.Errorf("failed to update the submodules of %s: %w", repoPath, err)
+		}
+	}
+
+	return nil
+}
+
+// rsync to the production environment on the same server
+func rsyncToLocalProduction(config *DeployConfig) error {
+	rsyncArgs := rsyncBaseArgs(config)
+
 	if config.UpgradeVendor {
-		src := PRODUCTIONPATH + "/vendor/"
-		dst := fmt.Sprintf("%s@%s:%s/vendor/", DEPLOYUSER, server, PRODUCTIONPATH)
-		fmt.Printf("-> Syncing vendor to %s...\n", server)
-		if err := runRsync(baseArgs, src, dst); err != nil {
+		src := STAGINGPATH + "/vendor/"
+		dst := config.localProduction() + "/vendor/"
+		if err := runRsync(nil, rsyncArgs, src, dst); err != nil {
 			return err
 		}
 	}
 
 	for _, ext := range config.UpgradeExtensions {
-		src := fmt.Sprintf("%s/extensions/%s/", PRODUCTIONPATH, ext)
-		dst := fmt.Sprintf("%s@%s:%s/extensions/%s/", DEPLOYUSER, server, PRODUCTIONPATH, ext)
-		fmt.Printf("-> Syncing extension %s to %s...\n", ext, server)
-		if err := runRsync(baseArgs, src, dst); err != nil {
+		src := config.sourcePath(fmt.Sprintf("%s/%s", EXTENSIONPATH, ext)) + "/"
+		dst := fmt.Sprintf("%s/%s/%s/", config.localProduction(), config.ProdExtensionsDir, ext)
+		if err := runRsync(nil, rsyncArgs, src, dst); err != nil {
 			return err
 		}
+		if err := writeDeployedMarkerFromRepo(src, dst, config); err != nil {
+			return err
+		}
+	}
+
+	for _, skin := range config.UpgradeSkins {
+		src := config.sourcePath(fmt.Sprintf("%s/%s", SKINPATH, skin)) + "/"
+		dst := fmt.Sprintf("%s/%s/%s/", config.localProduction(), config.ProdSkinsDir, skin)
+		if err := runRsync(nil, rsyncArgs, src, dst); err != nil {
+			return err
+		}
+		if err := writeDeployedMarkerFromRepo(src, dst, config); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// rebuild l10n
+func rebuildL10n(config *DeployConfig) error {
+	mergeScript := config.L10nMergeScript
+	if mergeScript == "" {
+		mergeScript = fmt.Sprintf("%s/%s/TelepediaMagic/maintenance/mergeMessageFileList.php", config.localProduction(), config.ProdExtensionsDir)
+	}
+
+	extensionsDir := config.L10nExtensionsDir
+	if extensionsDir == "" {
+		extensionsDir = fmt.Sprintf("%s/%s:%s/%s", config.localProduction(), config.ProdExtensionsDir, config.localProduction(), config.ProdSkinsDir)
+	}
+
+	if _, err := os.Stat(mergeScript); err != nil {
+		return fmt.Errorf("merge message files script is missing: %w", err)
+	}
+
+	err := runCommand(PHPBIN, mergeScript,
+		"--quiet",
+		"--wiki=metawiki",
+		"--extensions-dir="+extensionsDir,
+		"--output", config.localProduction()+"/config/ExtensionMessageFiles.php")
+
+	if err != nil {
+		return fmt.Errorf("failed to merge message files: %w", err)
+	}
+
+	rebuildScript := config.localProduction() + "/maintenance/rebuildLocalisationCache.php"
+	args := []string{rebuildScript, "--quiet", "--wiki=metawiki"}
+
+	if config.Lang != "" {
+		args = append(args, fmt.Sprintf("--lang=%s", config.Lang))
+	} else if config.L10nScope == L10NSCOPEAUTO {
+		scope := chooseL10nScope(config)
+		config.l10nScope = &scope
+		logf("Rebuilding localization cache for %s\n", scope)
+
+		if !scope.Full && len(scope.Langs) == 0 {
+			return nil
+		}
+		if !scope.Full {
+			args = append(args, "--lang="+strings.Join(scope.Langs, ","))
+		}
+	}
+
+	if err := runCommand(PHPBIN, args...); err != nil {
+		return fmt.Errorf("failed to rebuild l10n cache: %w", err)
+	}
+
+	return nil
+}
+
+// remember the commit a repo was at before this deploy pulled it; only the first pull counts, since
+// that's where the deploy started from
+func (c *DeployConfig) pullFrom(repoPath string, before string) {
+	if c.pulledFrom == nil {
+		c.pulledFrom = map[string]string{}
+	}
+	if _, ok := c.pulledFrom[repoPath]; !ok {
+		c.pulledFrom[repoPath] = before
+	}
+}
+
+// a single rsync of part of production to a remote server
+type remoteSync struct {
+	What string
+	Src  string
+	Dst  string
+}
+
+// work out what to rsync to another server
+// if we pass --config, we rsync the entire mediawiki install, otherwise, just the specific
+// stuff we asked for
+func remoteSyncs(server string, config *DeployConfig) []remoteSync {
+	if config.SyncConfig {
+		return []remoteSync{{
+			What: "[CONFIG] entire MediaWiki root",
+			Src:  PRODUCTIONPATH + "/",
+			Dst:  fmt.Sprintf("%s:%s/", sshTarget(server), PRODUCTIONPATH),
+		}}
+	}
+
+	var syncs []remoteSync
+
+	if config.UpgradeVendor {
+		syncs = append(syncs, remoteSync{
+			What: "vendor",
+			Src:  PRODUCTIONPATH + "/vendor/",
+			Dst:  fmt.Sprintf("%s:%s/vendor/", sshTarget(server), PRODUCTIONPATH),
+		})
+	}
+
+	for _, ext := range config.UpgradeExtensions {
+		syncs = append(syncs, remoteSync{
+			What: "extension " + ext,
+			Src:  fmt.Sprintf("%s/%s/%s/", PRODUCTIONPATH, config.ProdExtensionsDir, ext),
+			Dst:  fmt.Sprintf("%s:%s/%s/%s/", sshTarget(server), PRODUCTIONPATH, config.ProdExtensionsDir, ext),
+		})
 	}
 
 	for _, skin := range config.UpgradeSkins {
-		src := fmt.Sprintf("%s/skins/%s/", PRODUCTIONPATH, skin)
-		dst := fmt.Sprintf("%s@%s:%s/skins/%s/", DEPLOYUSER, server, PRODUCTIONPATH, skin)
-		fmt.Printf("-> Syncing skin %s to %s...\n", skin, server)
-		if err := runRsync(baseArgs, src, dst); err != nil {
+		syncs = append(syncs, remoteSync{
+			What: "skin " + skin,
+			Src:  fmt.Sprintf("%s/%s/%s/", PRODUCTIONPATH, config.ProdSkinsDir, skin),
+			Dst:  fmt.Sprintf("%s:%s/%s/%s/", sshTarget(server), PRODUCTIONPATH, config.ProdSkinsDir, skin),
+		})
+	}
+
+	return syncs
+}
+
+// the rsync args used for every sync to a remote server
+func remoteRsyncArgs(server string, config *DeployConfig) []string {
+	baseArgs := append([]string{"-e", rsyncSSHCommand(server)}, rsyncBaseArgs(config)...)
+
+	// compression only pays off over slow links, so it can be enabled for everything or per server
+	if config.Compress || contains(config.CompressServers, server) {
+		baseArgs = append(baseArgs, "-z")
+	}
+
+	if config.BwLimit != "" {
+		baseArgs = append(baseArgs, "--bwlimit="+config.BwLimit)
+	}
+
+	// an in-place update already leaves a partly transferred file where the next attempt picks it up,
+	// and rsync won't combine it with a partial dir
+	if config.Resumable && !config.IgnoreTime {
+		baseArgs = append(baseArgs, "--partial", "--partial-dir="+RESUMABLEPARTIALDIR)
+	}
+
+	return baseArgs
+}
+
+// rsync the changed files to the other servers
+func rsyncToRemoteServer(server string, config *DeployConfig) error {
+	out := newTaggedOutput(server)
+	defer out.Flush()
+
+	baseArgs := remoteRsyncArgs(server, config)
+
+	for _, sync := range remoteSyncs(server, config) {
+		out.logf("-> Syncing %s to %s...\n", sync.What, server)
+		err := runRsync(out, baseArgs, sync.Src, sync.Dst)
+
+		// rsync only sends what's still missing, so each attempt carries on from where the last one stopped;
+		// a failure which isn't down to the connection would only fail the same way again
+		for attempt := 1; err != nil && config.Resumable && isRetryableRsyncError(err) && attempt <= RESUMABLERETRIES; attempt++ {
+			out.logf("-> Syncing %s to %s failed, resuming in %s (attempt %d of %d): %v\n", sync.What, server, RESUMABLEBACKOFF, attempt, RESUMABLERETRIES, err)
+			time.Sleep(RESUMABLEBACKOFF)
+			err = runRsync(out, baseArgs, sync.Src, sync.Dst)
+		}
+
+		if err != nil {
 			return err
 		}
 	}
@@ -441,21 +2467,239 @@ func rsyncToRemoteServer(server string, config *DeployConfig) error {
 	return nil
 }
 
+// check whether a remote server is out of sync with local production, by asking rsync what it would change
+func remoteHasChanges(server string, config *DeployConfig) (bool, error) {
+	out := newTaggedOutput(server)
+	defer out.Flush()
+
+	baseArgs := remoteRsyncArgs(server, config)
+
+	for _, sync := range remoteSyncs(server, config) {
+		changes, err := rsyncItemize(out, baseArgs, sync.Src, sync.Dst)
+		if err != nil {
+			return false, err
+		}
+		if changes != "" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 // helper to run a command
 func runCommand(name string, args ...string) error {
-	cmd := exec.Command(name, args...)
-	cmd.Stdout = os.Stdout
+	return runCommandIn("", name, args...)
+}
+
+// helper to run a command in a specific directory
+func runCommandIn(dir string, name string, args ...string) error {
+	return runCommandOut(nil, dir, name, args...)
+}
+
+// helper to run a command in a specific directory with its output tagged; with --dry-run the command is
+// only printed, since everything run through here changes something
+func runCommandOut(out *taggedOutput, dir string, name string, args ...string) error {
+	if DRYRUN {
+		out.logf("Would run: %s\n", renderCommand(dir, name, args))
+		return nil
+	}
+
+	traceCommand(out, dir, name, args)
+	cmd, ctx, cancel := newCommand(name, args...)
+	defer cancel()
+	cmd.Dir = dir
+	cmd.Stdout = out.Stdout()
+	cmd.Stderr = out.Stderr()
+	return checkTimeout(ctx, cmd, cmd.Run())
+}
+
+// helper to run a git command in a repo and return its trimmed output
+func gitOutput(repoPath string, args ...string) (string, error) {
+	args = append([]string{"-C", repoPath}, args...)
+	traceCommand(nil, "", "git", args)
+	cmd, ctx, cancel := newCommand("git", args...)
+	defer cancel()
 	cmd.Stderr = os.Stderr
-	return cmd.Run()
+	out, err := cmd.Output()
+	if err := checkTimeout(ctx, cmd, err); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(out)), nil
+}
+
+// helper to create a command which is killed once it runs for longer than the timeout set for it
+// in COMMANDTIMEOUTS, if there is one
+func newCommand(name string, args ...string) (*exec.Cmd, context.Context, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if timeout := COMMANDTIMEOUTS[name]; timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+	}
+
+	return exec.CommandContext(ctx, name, args...), ctx, cancel
+}
+
+// turn the error of a command which was killed for taking too long into one which says so
+func checkTimeout(ctx context.Context, cmd *exec.Cmd, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		logf("Timed out after %s: %s\n", COMMANDTIMEOUTS[cmd.Args[0]], strings.Join(cmd.Args, " "))
+		return fmt.Errorf("%w after %s: %s", ErrTimeout, COMMANDTIMEOUTS[cmd.Args[0]], strings.Join(cmd.Args, " "))
+	}
+
+	return err
+}
+
+// the rsync args shared by local and remote syncs
+func rsyncBaseArgs(config *DeployConfig) []string {
+	var args []string
+
+	if config.IgnoreTime {
+		args = append(args, "--inplace")
+	} else {
+		args = append(args, "--update")
+	}
+
+	// rsync keeps a copy of every changed file until the end of the transfer, so this needs up to the size
+	// of the changed files again in temporary disk space on the destination
+	if config.Atomic {
+		args = append(args, "--delay-updates")
+	}
+
+	// without --perms rsync only applies --chmod to files it creates, so an existing file with odd
+	// permissions would keep them
+	if config.Chmod != "" {
+		args = append(args, "--perms", "--chmod="+config.Chmod)
+	}
+
+	// rsync uses the first matching rule, so these have to come before the --exclude=.* in runRsync
+	for _, pattern := range config.Include {
+		args = append(args, "--include="+pattern)
+	}
+
+	return args
+}
+
+// check whether a repo is a shallow clone, since anything that walks history can't be trusted on one
+func isShallowRepo(repoPath string) (bool, error) {
+	shallow, err := gitOutput(repoPath, "rev-parse", "--is-shallow-repository")
+	if err != nil {
+		return false, err
+	}
+
+	return shallow == "true", nil
 }
 
-// helper to run rsync
-func runRsync(baseArgs []string, src, dst string) error {
+// helper to run rsync; with --dry-run rsync still runs, but only to itemize what it would change
+func runRsync(out *taggedOutput, baseArgs []string, src, dst string) error {
+	if DRYRUN {
+		changes, err := rsyncItemize(out, baseArgs, src, dst)
+		if err != nil {
+			return err
+		}
+
+		DRYRUNPLAN.add(src, dst, changes)
+		return nil
+	}
+
 	args := append(baseArgs, "-r", "--delete", "--exclude=.*", src, dst)
+	if RSYNCSTATS == nil {
+		return checkRsyncError(out, runCommandOut(out, "", "rsync", args...), src, dst)
+	}
+
+	// the summary is summed up into one line here and the totals at the end, rather than printed as it is
+	args = append([]string{"--stats"}, args...)
+	traceCommand(out, "", "rsync", args)
+	cmd, ctx, cancel := newCommand("rsync", args...)
+	defer cancel()
+	cmd.Stderr = out.Stderr()
+	output, err := cmd.Output()
+	if err := checkRsyncError(out, checkTimeout(ctx, cmd, err), src, dst); err != nil {
+		return err
+	}
+
+	if stats, ok := parseRsyncStats(string(output)); ok {
+		RSYNCSTATS.add(rsyncDestServer(dst), stats)
+		out.logf("-> %d files, %s transferred to %s (speedup %.2f)\n", stats.FilesTransferred, formatBytes(stats.BytesSent+stats.BytesReceived), dst, stats.Speedup)
+	}
+	return nil
+}
+
+// helper to ask rsync what it would change without changing anything, one itemized line per change
+func rsyncItemize(out *taggedOutput, baseArgs []string, src, dst string) (string, error) {
+	args := append(baseArgs, "-r", "--delete", "--exclude=.*", "-n", "--itemize-changes", src, dst)
+	traceCommand(out, "", "rsync", args)
+
+	cmd, ctx, cancel := newCommand("rsync", args...)
+	defer cancel()
+	cmd.Stderr = out.Stderr()
+	changes, err := cmd.Output()
+	if err := checkRsyncError(out, checkTimeout(ctx, cmd, err), src, dst); err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(string(changes)), nil
+}
+
+// helper to quote an argument for a remote shell, e.g. in a command run over ssh
+func shellQuote(arg string) string {
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// helper to render a command the way it's actually run, one shell word per argument, so the line can be
+// pasted into a shell as it is
+func renderCommand(dir string, name string, args []string) string {
+	words := []string{shellWord(name)}
+	for _, arg := range args {
+		words = append(words, shellWord(arg))
+	}
+
+	line := strings.Join(words, " ")
+	if dir != "" {
+		line = "cd " + shellWord(dir) + " && " + line
+	}
+	return line
+}
 
-	fmt.Printf("DEBUG: Executing rsync with args: %v\n", args)
+// helper to quote an argument for a shell only if it would otherwise be split or expanded
+func shellWord(arg string) string {
+	if arg == "" || strings.ContainsFunc(arg, needsQuoting) {
+		return shellQuote(arg)
+	}
+	return arg
+}
+
+// characters which are safe unquoted in a shell word; anything else gets the word quoted
+func needsQuoting(r rune) bool {
+	return !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./_-", r))
+}
+
+// with --verbose, print a command just before it's run
+func traceCommand(out *taggedOutput, dir string, name string, args []string) {
+	if VERBOSE {
+		out.logf("+ %s\n", renderCommand(dir, name, args))
+	}
+}
+
+// helper to keep only the items of a []string array which are also in keep, preserving their order
+func filterList(slice []string, keep []string) []string {
+	var filtered []string
+	for _, s := range slice {
+		if contains(keep, s) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered
+}
 
-	return runCommand("rsync", args...)
+// helper to check if a name matches any of a list of glob patterns, e.g. from --include
+func matchesAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
 }
 
 // helper to check if a []string array contains a specific item
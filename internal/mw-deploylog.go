@@ -0,0 +1,377 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// where every deploy appends what it did, one JSON entry per line
+func deployLogFile() string {
+	return STAGINGPATH + "/.deploy-log.jsonl"
+}
+
+// how often utils tail-deploy-log checks the deploy log for new entries
+const DEPLOYLOGPOLL = 500 * time.Millisecond
+
+// a single entry in the deploy log; every deploy writes a start entry, an entry for each step on each
+// server, and a finish entry, all sharing the same deploy id
+type deployLogEntry struct {
+	Time    time.Time `json:"time"`
+	Deploy  string    `json:"deploy"`
+	Event   string    `json:"event"`
+	User    string    `json:"user,omitempty"`
+	Args    []string  `json:"args,omitempty"`
+	Message string    `json:"message,omitempty"`
+	Server  string    `json:"server,omitempty"`
+	Step    string    `json:"step,omitempty"`
+	Outcome string    `json:"outcome,omitempty"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// the deploy log of the running deploy; nil when there isn't one, e.g. for a dry run
+type deployLog struct {
+	file *os.File
+	id   string
+	mu   sync.Mutex
+}
+
+// the deploy log steps are recorded to as they finish
+var DEPLOYLOG *deployLog
+
+// the user running the deploy, going by who ran sudo if it was used
+func deployingUser() string {
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		return sudoUser
+	}
+
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+
+	return "unknown"
+}
+
+// open the deploy log for appending and record that a deploy started
+func openDeployLog(args []string, message string) (*deployLog, error) {
+	file, err := os.OpenFile(deployLogFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open deploy log: %w", err)
+	}
+
+	l := &deployLog{file: file, id: fmt.Sprintf("%s-%d", HOSTNAME, time.Now().UnixNano())}
+	l.write(deployLogEntry{Event: "start", User: deployingUser(), Args: redactArgs(args), Message: message})
+
+	return l, nil
+}
+
+// the flags whose values are secrets, which are left out of the deploy log
+var REDACTEDFLAGS = []string{"notify-webhook"}
+
+// replace the values of secret flags with a placeholder, whether given as --flag=value or --flag value
+func redactArgs(args []string) []string {
+	redacted := append([]string{}, args...)
+	for i := 0; i < len(redacted); i++ {
+		name, _, hasValue := strings.Cut(strings.TrimLeft(redacted[i], "-"), "=")
+		if !strings.HasPrefix(redacted[i], "-") || !contains(REDACTEDFLAGS, name) {
+			continue
+		}
+
+		if hasValue {
+			redacted[i] = redacted[i][:strings.Index(redacted[i], "=")+1] + "REDACTED"
+		} else if i+1 < len(redacted) {
+			i++
+			redacted[i] = "REDACTED"
+		}
+	}
+
+	return redacted
+}
+
+func (l *deployLog) write(entry deployLogEntry) {
+	if l == nil {
+		return
+	}
+
+	entry.Time = time.Now().UTC()
+	entry.Deploy = l.id
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// the deploy log is for following along, failing to write it mustn't fail the deploy
+	if _, err := l.file.Write(append(data, '\n')); err != nil {
+		logf("Failed to write to deploy log: %v\n", err)
+	}
+}
+
+// record how a step on a server went
+func (l *deployLog) step(server string, step string, outcome string, err error) {
+	entry := deployLogEntry{Event: "step", Server: server, Step: step, Outcome: outcome}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	l.write(entry)
+}
+
+// record how the deploy ended and close the log
+func (l *deployLog) finish(err error) {
+	if l == nil {
+		return
+	}
+
+	entry := deployLogEntry{Event: "finish", Outcome: "success"}
+	if err != nil {
+		entry.Outcome, entry.Error = "failure", err.Error()
+	}
+	l.write(entry)
+	l.file.Close()
+}
+
+// follow the deploy log like tail -f, optionally replaying recent entries first
+func runTailDeployLog(args []string) {
+	tailCmd := flag.NewFlagSet("tail-deploy-log", flag.ExitOnError)
+	server := tailCmd.String("server", "", "Only show entries for this server")
+	outcome := tailCmd.String("outcome", "", "Only show entries with this outcome (ok, failed, skipped, success or failure)")
+	since := tailCmd.Duration("since", 0, "Replay entries from this long ago before following (e.g. 1h)")
+	tailCmd.Parse(args)
+
+	// nothing has been deployed yet, so wait for the first deploy to start the log
+	file, err := os.Open(deployLogFile())
+	waited := false
+	for errors.Is(err, os.ErrNotExist) {
+		time.Sleep(DEPLOYLOGPOLL)
+		file, err = os.Open(deployLogFile())
+		waited = true
+	}
+	if err != nil {
+		ExitWithError(fmt.Errorf("failed to open deploy log: %w", err), 1)
+	}
+	defer file.Close()
+
+	show := func(line string) {
+		var entry deployLogEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return
+		}
+
+		if (*server != "" && entry.Server != *server) || (*outcome != "" && entry.Outcome != *outcome) {
+			return
+		}
+		if *since > 0 && entry.Time.Before(time.Now().Add(-*since)) {
+			return
+		}
+
+		if JSONOUTPUT {
+			fmt.Println(line)
+			return
+		}
+		fmt.Println(formatDeployLogEntry(entry))
+	}
+
+	// anything already in the log is only shown if it was asked for with --since, unless it's all new
+	if *since == 0 && !waited {
+		if _, err := file.Seek(0, io.SeekEnd); err != nil {
+			ExitWithError(fmt.Errorf("failed to read deploy log: %w", err), 1)
+		}
+	}
+
+	reader := bufio.NewReader(file)
+	var partial string
+	for {
+		line, err := reader.ReadString('\n')
+		partial += line
+
+		if err == io.EOF {
+			time.Sleep(DEPLOYLOGPOLL)
+			continue
+		}
+		if err != nil {
+			ExitWithError(fmt.Errorf("failed to read deploy log: %w", err), 1)
+		}
+
+		show(strings.TrimSpace(partial))
+		partial = ""
+	}
+}
+
+// format a deploy log entry for humans
+func formatDeployLogEntry(entry deployLogEntry) string {
+	line := entry.Time.Local().Format("2006-01-02 15:04:05") + " "
+
+	switch entry.Event {
+	case "start":
+		line += fmt.Sprintf("deploy %s started by %s: %s", entry.Deploy, entry.User, strings.Join(entry.Args, " "))
+		if entry.Message != "" {
+			line += fmt.Sprintf(" (%s)", entry.Message)
+		}
+	case "finish":
+		line += fmt.Sprintf("deploy %s finished: %s", entry.Deploy, entry.Outcome)
+	default:
+		line += fmt.Sprintf("[%s] %s %s", entry.Server, entry.Step, entry.Outcome)
+	}
+
+	if entry.Error != "" {
+		line += ": " + entry.Error
+	}
+
+	return line
+}
+
+// what utils last-deploy shows about a deploy, pieced together from its deploy log entries
+type deploySummary struct {
+	Deploy     string     `json:"deploy"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	User       string     `json:"user"`
+	Args       []string   `json:"args"`
+	Message    string     `json:"message,omitempty"`
+	Servers    []string   `json:"servers"`
+	Items      []string   `json:"items"`
+	Failed     []string   `json:"failed"`
+	Outcome    string     `json:"outcome"`
+	Error      string     `json:"error,omitempty"`
+}
+
+// read the deploy log and summarize the most recent deploy in it; nil if nothing has been deployed
+func lastDeploy() (*deploySummary, error) {
+	file, err := os.Open(deployLogFile())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open deploy log: %w", err)
+	}
+	defer file.Close()
+
+	var summary *deploySummary
+	seenServers, seenItems := map[string]bool{}, map[string]bool{}
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry deployLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue
+		}
+
+		// every start begins a new deploy, the last one in the log is the most recent
+		if entry.Event == "start" {
+			summary = &deploySummary{
+				Deploy:    entry.Deploy,
+				StartedAt: entry.Time,
+				User:      entry.User,
+				Args:      entry.Args,
+				Message:   entry.Message,
+				Servers:   []string{},
+				Items:     []string{},
+				Failed:    []string{},
+				Outcome:   "unfinished",
+			}
+			seenServers, seenItems = map[string]bool{}, map[string]bool{}
+			continue
+		}
+
+		// entries from a deploy running alongside, or one whose start was lost
+		if summary == nil || entry.Deploy != summary.Deploy {
+			continue
+		}
+
+		switch entry.Event {
+		case "step":
+			if !seenServers[entry.Server] {
+				seenServers[entry.Server] = true
+				summary.Servers = append(summary.Servers, entry.Server)
+			}
+			if isDeployItem(entry.Step) && !seenItems[entry.Step] {
+				seenItems[entry.Step] = true
+				summary.Items = append(summary.Items, entry.Step)
+			}
+			if entry.Outcome == "failed" {
+				summary.Failed = append(summary.Failed, fmt.Sprintf("%s %s: %s", entry.Server, entry.Step, entry.Error))
+			}
+		case "finish":
+			finishedAt := entry.Time
+			summary.FinishedAt = &finishedAt
+			summary.Outcome = entry.Outcome
+			summary.Error = entry.Error
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read deploy log: %w", err)
+	}
+
+	return summary, nil
+}
+
+// whether a step is something that was deployed, as opposed to e.g. syncing to a server
+func isDeployItem(step string) bool {
+	return step == "vendor" || step == "l10n" || strings.HasPrefix(step, "extension:") || strings.HasPrefix(step, "skin:")
+}
+
+// print when the most recent deploy happened, who ran it, what it deployed where and how it went
+func runLastDeploy(args []string) {
+	lastCmd := flag.NewFlagSet("last-deploy", flag.ExitOnError)
+	lastCmd.Parse(args)
+
+	summary, err := lastDeploy()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+	if summary == nil {
+		ExitWithError(fmt.Errorf("no deploys found in %s", deployLogFile()), 1)
+	}
+
+	if JSONOUTPUT {
+		printJSON(summary)
+		return
+	}
+
+	none := func(list []string) string {
+		if len(list) == 0 {
+			return "none"
+		}
+		return strings.Join(list, ", ")
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Deploy:\t%s\n", summary.Deploy)
+	fmt.Fprintf(w, "Started:\t%s (%s ago)\n", summary.StartedAt.Local().Format("2006-01-02 15:04:05"), time.Since(summary.StartedAt).Round(time.Second))
+	if summary.FinishedAt != nil {
+		fmt.Fprintf(w, "Duration:\t%s\n", summary.FinishedAt.Sub(summary.StartedAt).Round(time.Second))
+	}
+	fmt.Fprintf(w, "User:\t%s\n", summary.User)
+	fmt.Fprintf(w, "Command:\t%s\n", strings.Join(summary.Args, " "))
+	if summary.Message != "" {
+		fmt.Fprintf(w, "Message:\t%s\n", summary.Message)
+	}
+	fmt.Fprintf(w, "Servers:\t%s\n", none(summary.Servers))
+	fmt.Fprintf(w, "Items:\t%s\n", none(summary.Items))
+	outcome := summary.Outcome
+	if summary.Error != "" {
+		outcome += ": " + summary.Error
+	}
+	fmt.Fprintf(w, "Outcome:\t%s\n", outcome)
+	w.Flush()
+
+	if len(summary.Failed) > 0 {
+		fmt.Println("Failures:")
+	}
+	for _, failure := range summary.Failed {
+		fmt.Printf("  %s\n", failure)
+	}
+}
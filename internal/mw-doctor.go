@@ -0,0 +1,211 @@
+package internal
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// binaries the deploy needs on PATH, along with the configured php and composer
+var REQUIREDBINARIES = []string{"git", "rsync", "ssh"}
+
+// the outcome of a single doctor check, with a hint on how to fix it if it failed
+type doctorCheck struct {
+	Name string `json:"name"`
+	Pass bool   `json:"pass"`
+	Info string `json:"info,omitempty"`
+	Hint string `json:"hint,omitempty"`
+}
+
+// check that everything the tool needs is in place, printing a checklist of what passed and what didn't
+func runDoctor(args []string) {
+	doctorCmd := flag.NewFlagSet("doctor", flag.ExitOnError)
+	noSSH := doctorCmd.Bool("no-ssh", false, "Skip checking that every server is reachable over SSH")
+	doctorCmd.Parse(args)
+
+	var checks []doctorCheck
+
+	for _, binary := range append(REQUIREDBINARIES, COMPOSERBIN, PHPBIN) {
+		check := doctorCheck{Name: "binary " + binary}
+		if path, err := exec.LookPath(binary); err != nil {
+			check.Hint = fmt.Sprintf("install %s or add it to PATH", binary)
+		} else {
+			check.Pass, check.Info = true, path
+		}
+		checks = append(checks, check)
+	}
+
+	paths := []struct{ name, path string }{
+		{"staging path", STAGINGPATH},
+		{"production path", PRODUCTIONPATH},
+		{"extension path", EXTENSIONPATH},
+		{"skin path", SKINPATH},
+	}
+	for _, p := range paths {
+		checks = append(checks, checkWritableDir(p.name, p.path))
+	}
+
+	keyCheck := doctorCheck{Name: "deploy key", Info: DEPLOYKEY}
+	if file, err := os.Open(DEPLOYKEY); err != nil {
+		keyCheck.Hint = fmt.Sprintf("make sure the deploy key exists and is readable by this user: %v", err)
+	} else {
+		file.Close()
+		keyCheck.Pass = true
+	}
+	checks = append(checks, keyCheck)
+	if keyCheck.Pass {
+		checks = append(checks, checkKeyPermissions(DEPLOYKEY, false))
+	}
+
+	hname, err := getShortHostname()
+	hostCheck := doctorCheck{Name: "current host", Info: hname}
+	if err != nil {
+		hostCheck.Hint = fmt.Sprintf("could not determine hostname: %v", err)
+	} else if !isDeployHost(hname) {
+		hostCheck.Hint = fmt.Sprintf("%s isn't one of the deploy hosts %v, add it to the servers or deploy_hosts in the settings file", hname, deployHosts())
+	} else {
+		hostCheck.Pass = true
+	}
+	checks = append(checks, hostCheck)
+
+	if !*noSSH {
+		for _, server := range ALLSERVERS {
+			if server == hname {
+				continue
+			}
+			checks = append(checks, checkSSH(server))
+		}
+	}
+
+	failed := 0
+	for _, check := range checks {
+		if !check.Pass {
+			failed++
+		}
+	}
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"pass": failed == 0, "checks": checks})
+	} else {
+		for _, check := range checks {
+			status := "PASS"
+			if !check.Pass {
+				status = "FAIL"
+			}
+
+			line := fmt.Sprintf("[%s] %s", status, check.Name)
+			if check.Info != "" {
+				line += " (" + check.Info + ")"
+			}
+			if check.Hint != "" {
+				line += " - " + check.Hint
+			}
+			fmt.Println(line)
+		}
+
+		if failed > 0 {
+			fmt.Printf("%d of %d checks failed\n", failed, len(checks))
+		} else {
+			fmt.Printf("All %d checks passed\n", len(checks))
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// check that a directory exists and that we can write to it
+func checkWritableDir(name string, path string) doctorCheck {
+	check := doctorCheck{Name: name, Info: path}
+
+	info, err := os.Stat(path)
+	switch {
+	case err != nil:
+		check.Hint = fmt.Sprintf("create it, or set the right path in the settings file: %v", err)
+	case !info.IsDir():
+		check.Hint = "this should be a directory"
+	case syscall.Access(path, 0x2) != nil:
+		check.Hint = "this user can't write to it, fix its ownership or permissions"
+	default:
+		check.Pass = true
+	}
+
+	return check
+}
+
+// check that we can log in to a server over SSH with the deploy key, without prompting for anything
+func checkSSH(server string) doctorCheck {
+	check := doctorCheck{Name: "ssh " + server}
+
+	args := append(sshArgs(server), "-o", "BatchMode=yes", "-o", "ConnectTimeout=5", sshTarget(server), "true")
+	cmd := exec.Command("ssh", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		check.Hint = fmt.Sprintf("can't log in as %s with the deploy key: %v %s", sshUser(server), err, string(out))
+	} else {
+		check.Pass = true
+	}
+
+	return check
+}
+
+// check a private key is only readable by its owner and owned by whoever is running the tool, since ssh
+// otherwise refuses to use it with nothing more than "bad permissions"; with fix, loose permissions are
+// tightened to 0600
+func checkKeyPermissions(path string, fix bool) doctorCheck {
+	check := doctorCheck{Name: "deploy key permissions", Info: path}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		check.Hint = fmt.Sprintf("make sure the deploy key exists: %v", err)
+		return check
+	}
+
+	mode := info.Mode().Perm()
+	check.Info = fmt.Sprintf("%s %#o", path, mode)
+
+	if mode&0077 != 0 && fix {
+		if err := os.Chmod(path, 0600); err != nil {
+			check.Hint = fmt.Sprintf("failed to chmod it to 0600: %v", err)
+			return check
+		}
+		mode = 0600
+		check.Info = fmt.Sprintf("%s %#o, fixed", path, mode)
+	}
+
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && int(stat.Uid) != os.Geteuid() {
+		check.Hint = fmt.Sprintf("it's owned by uid %d rather than uid %d which is running deploys, ssh won't use it; chown it to that user", stat.Uid, os.Geteuid())
+		return check
+	}
+
+	if mode&0077 != 0 {
+		check.Hint = "it can be read by its group or everyone, ssh won't use it; chmod it to 0600 (or run with --fix)"
+		return check
+	}
+
+	check.Pass = true
+	return check
+}
+
+// check the deploy key's permissions on their own, fixing them with --fix
+func runVerifyKeyPermissions(args []string) {
+	verifyCmd := flag.NewFlagSet("verify-key-permissions", flag.ExitOnError)
+	fix := verifyCmd.Bool("fix", false, "chmod the deploy key to 0600 if its group or everyone can read it")
+	verifyCmd.Parse(args)
+
+	check := checkKeyPermissions(DEPLOYKEY, *fix)
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"pass": check.Pass, "checks": []doctorCheck{check}})
+	} else if check.Pass {
+		fmt.Printf("PASS: %s (%s)\n", check.Name, check.Info)
+	} else {
+		fmt.Printf("FAIL: %s (%s) - %s\n", check.Name, check.Info, check.Hint)
+	}
+
+	if !check.Pass {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// lines in an error log which count as an error
+var ERRORLOGPATTERN = regexp.MustCompile(`(?i)\b(fatal|error)\b`)
+
+// the new error log entries seen on a single server while watching
+type errorLogResult struct {
+	Server string
+	Lines  []string
+	Err    error
+}
+
+// watch the error log on every server for a while after the deploy, collecting any new error entries
+func watchErrorLogs(servers []string, path string, window time.Duration) []errorLogResult {
+	results := make([]errorLogResult, len(servers))
+	var wg sync.WaitGroup
+
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lines, err := tailErrorLog(server, path, window)
+			results[i] = errorLogResult{Server: server, Lines: lines, Err: err}
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+// follow the error log on a server for the window, returning only the lines written during it which look
+// like errors; the remote side is bounded by timeout as well so that nothing is left running there
+func tailErrorLog(server string, path string, window time.Duration) ([]string, error) {
+	seconds := fmt.Sprintf("%d", int(window.Seconds()))
+
+	var cmd *exec.Cmd
+	if server == HOSTNAME {
+		cmd = exec.Command("timeout", seconds, "tail", "-n0", "-F", path)
+	} else {
+		remote := fmt.Sprintf("timeout %s tail -n0 -F %s", seconds, shellQuote(path))
+		cmd = exec.Command("ssh", append(sshArgs(server), sshTarget(server), remote)...)
+	}
+
+	traceCommand(nil, "", cmd.Args[0], cmd.Args[1:])
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+
+	// timeout exits with 124 once the window is up, which is how this is meant to end
+	var exitErr *exec.ExitError
+	if err != nil && !(errors.As(err, &exitErr) && exitErr.ExitCode() == 124) {
+		return nil, fmt.Errorf("failed to watch %s on %s: %w %s", path, server, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		if ERRORLOGPATTERN.MatchString(line) {
+			lines = append(lines, line)
+		}
+	}
+
+	return lines, nil
+}
+
+// whether an error log line mentions any of the extensions or skins which were just deployed
+func mentionsDeployed(line string, config *DeployConfig) bool {
+	for _, ext := range config.UpgradeExtensions {
+		if strings.Contains(line, "/"+ext+"/") {
+			return true
+		}
+	}
+
+	for _, skin := range config.UpgradeSkins {
+		if strings.Contains(line, "/"+skin+"/") {
+			return true
+		}
+	}
+
+	return config.UpgradeVendor && strings.Contains(line, "/vendor/")
+}
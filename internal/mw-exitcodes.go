@@ -0,0 +1,79 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// what a deploy exits with, so that wrappers can tell what kind of failure it was
+const (
+	// anything which doesn't fit one of the classes below, e.g. a hook or health check failing
+	EXITFAILURE = 1
+	// the flags, settings or what was asked for are wrong; nothing was changed (flag parsing errors exit
+	// with this too)
+	EXITCONFIG = 2
+	// updating vendor, an extension or a skin failed, or staging wasn't fit to deploy from (dirty, stale, or
+	// maintenance scripts were already running)
+	EXITGIT = 3
+	// syncing to this server's production tree or a remote server failed
+	EXITRSYNC = 4
+	// rebuilding or syncing the localization cache failed
+	EXITL10N = 5
+)
+
+// an error which decides the exit code of a deploy
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// tag an error with the code the deploy should exit with if it fails because of it
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &exitError{code: code, err: err}
+}
+
+// the code a deploy which failed with this error should exit with
+func exitCodeOf(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	return EXITFAILURE
+}
+
+// the exit code for a failed step of a deploy, by what kind of step it is
+func stepExitCode(step string) int {
+	switch {
+	case step == "vendor" || strings.HasPrefix(step, "extension:") || strings.HasPrefix(step, "skin:") || strings.HasPrefix(step, "composer:"):
+		return EXITGIT
+	case step == "rsync-local" || step == "sync":
+		return EXITRSYNC
+	case step == "l10n":
+		return EXITL10N
+	}
+	return EXITFAILURE
+}
+
+// list the exit codes under the deploy flags in --help
+func printExitCodes(w io.Writer) {
+	fmt.Fprintf(w, "\nExit codes:\n")
+	fmt.Fprintf(w, "  %d  success\n", 0)
+	fmt.Fprintf(w, "  %d  any other failure, e.g. a hook or health check\n", EXITFAILURE)
+	fmt.Fprintf(w, "  %d  invalid flags, settings or selection\n", EXITCONFIG)
+	fmt.Fprintf(w, "  %d  updating vendor, an extension or a skin failed, staging was dirty or stale, or maintenance scripts were already running\n", EXITGIT)
+	fmt.Fprintf(w, "  %d  rsync to production or a remote server failed\n", EXITRSYNC)
+	fmt.Fprintf(w, "  %d  rebuilding or syncing the localization cache failed\n", EXITL10N)
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// a step an extension asks to be run once it's been deployed, declared in its extension.json as e.g.
+//
+//	"telepedia": {"deployHooks": [{"script": "maintenance/migrateFoo.php", "args": ["--batch-size=100"]}]}
+//
+// only maintenance scripts in the extension itself can be run, with plain --option or --option=value
+// arguments, so an extension can't run anything else on the deploy host. Hooks are only run with
+// --extension-hooks, so an upstream change to extension.json alone can't make a deploy run anything
+type extensionDeployHook struct {
+	Script string   `json:"script"`
+	Args   []string `json:"args"`
+}
+
+// what a deploy hook argument can look like; nothing the shell or php could read as anything but an option
+var deployHookArgPattern = regexp.MustCompile(`^--[A-Za-z0-9][A-Za-z0-9-]*(=[A-Za-z0-9_.,:/@+-]*)?$`)
+
+// check a hook only runs a maintenance script of the extension in dir, with safe arguments
+func (h extensionDeployHook) validate(dir string) error {
+	script := filepath.ToSlash(filepath.Clean(h.Script))
+	if h.Script == "" || filepath.IsAbs(h.Script) || script != h.Script || !strings.HasPrefix(script, "maintenance/") || !strings.HasSuffix(script, ".php") {
+		return fmt.Errorf("deploy hook script %q must be a .php file in the extension's maintenance directory, e.g. maintenance/migrateFoo.php", h.Script)
+	}
+
+	// a symlink anywhere along the way, including the maintenance directory itself, could point anywhere,
+	// so the script has to still be in the extension once they're all resolved
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fmt.Errorf("deploy hook script %s: %w", script, err)
+	}
+	resolved, err := filepath.EvalSymlinks(filepath.Join(dir, script))
+	if err != nil {
+		return fmt.Errorf("deploy hook script %s: %w", script, err)
+	}
+	if rel, err := filepath.Rel(root, resolved); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+		return fmt.Errorf("deploy hook script %s resolves to %s, outside the extension", script, resolved)
+	}
+
+	info, err := os.Stat(resolved)
+	if err != nil {
+		return fmt.Errorf("deploy hook script %s: %w", script, err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("deploy hook script %s must be a regular file", script)
+	}
+
+	for _, arg := range h.Args {
+		if !deployHookArgPattern.MatchString(arg) {
+			return fmt.Errorf("deploy hook %s has an argument which isn't a plain --option or --option=value: %q", script, arg)
+		}
+	}
+
+	return nil
+}
+
+// the deploy hooks an extension declares, checked against the copy being deployed
+func extensionDeployHooks(ext string, config *DeployConfig) ([]extensionDeployHook, error) {
+	r := repo{Name: "extensions/" + ext, Path: config.sourcePath(fmt.Sprintf("%s/%s", EXTENSIONPATH, ext)), Short: ext}
+	manifest, err := readManifest(r)
+	if err != nil || manifest == nil {
+		return nil, err
+	}
+
+	for _, hook := range manifest.Telepedia.DeployHooks {
+		if err := hook.validate(r.Path); err != nil {
+			return nil, fmt.Errorf("%s: %w", r.manifestPath(), err)
+		}
+	}
+
+	return manifest.Telepedia.DeployHooks, nil
+}
+
+// run an extension's deploy hooks against its deployed copy in production, in the order it declares them
+func runExtensionDeployHooks(ext string, hooks []extensionDeployHook, config *DeployConfig) error {
+	for _, hook := range hooks {
+		args := []string{fmt.Sprintf("%s/%s/%s/%s", PRODUCTIONPATH, config.ProdExtensionsDir, ext, hook.Script)}
+
+		// every other maintenance script we run is against metawiki, unless the hook says otherwise
+		hasWiki := false
+		for _, arg := range hook.Args {
+			hasWiki = hasWiki || strings.HasPrefix(arg, "--wiki=")
+		}
+		if !hasWiki {
+			args = append(args, "--wiki=metawiki")
+		}
+
+		logf("Running %s deploy hook %s...\n", ext, hook.Script)
+		if err := runCommand(PHPBIN, append(args, hook.Args...)...); err != nil {
+			return fmt.Errorf("%s deploy hook %s failed: %w", ext, hook.Script, err)
+		}
+	}
+
+	return nil
+}
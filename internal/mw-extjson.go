@@ -0,0 +1,360 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// the parts of an extension.json or skin.json we care about
+type extensionManifest struct {
+	Name     string `json:"name"`
+	Requires struct {
+		Extensions map[string]string `json:"extensions"`
+		Skins      map[string]string `json:"skins"`
+	} `json:"requires"`
+	Telepedia struct {
+		DeployHooks []extensionDeployHook `json:"deployHooks"`
+	} `json:"telepedia"`
+}
+
+// the file a repo declares itself in
+func (r repo) manifestPath() string {
+	if r.IsSkin {
+		return r.Path + "/skin.json"
+	}
+	return r.Path + "/extension.json"
+}
+
+// read the extension.json or skin.json of a repo; old style extensions without one return nil
+func readManifest(r repo) (*extensionManifest, error) {
+	data, err := os.ReadFile(r.manifestPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest extensionManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", r.manifestPath(), err)
+	}
+
+	return &manifest, nil
+}
+
+// what every repo requires, keyed by repo name, e.g. extensions/Echo; requirements are sorted so the
+// graph is the same every time
+func dependencyGraph(repos []repo) (map[string][]string, error) {
+	graph := map[string][]string{}
+
+	for _, r := range repos {
+		manifest, err := readManifest(r)
+		if err != nil {
+			return nil, err
+		}
+
+		graph[r.Name] = []string{}
+		if manifest == nil {
+			continue
+		}
+
+		for ext := range manifest.Requires.Extensions {
+			graph[r.Name] = append(graph[r.Name], "extensions/"+ext)
+		}
+		for skin := range manifest.Requires.Skins {
+			graph[r.Name] = append(graph[r.Name], "skins/"+skin)
+		}
+		sort.Strings(graph[r.Name])
+	}
+
+	return graph, nil
+}
+
+// find every cycle in the graph, each as the path around it, e.g. [extensions/A extensions/B extensions/A]
+func findCycles(graph map[string][]string) [][]string {
+	var names []string
+	for name := range graph {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[string]int{}
+	var path []string
+	var cycles [][]string
+
+	var visit func(name string)
+	visit = func(name string) {
+		state[name] = visiting
+		path = append(path, name)
+
+		for _, dep := range graph[name] {
+			switch state[dep] {
+			case visiting:
+				start := 0
+				for i, p := range path {
+					if p == dep {
+						start = i
+					}
+				}
+				cycle := append(append([]string{}, path[start:]...), dep)
+				cycles = append(cycles, cycle)
+			case unvisited:
+				if _, ok := graph[dep]; ok {
+					visit(dep)
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+	}
+
+	for _, name := range names {
+		if state[name] == unvisited {
+			visit(name)
+		}
+	}
+
+	return cycles
+}
+
+// show which extensions and skins require which others, and flag any requirements which aren't here or
+// which go round in a cycle
+func runExtensionDeps() {
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	graph, err := dependencyGraph(repos)
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	var missing []string
+	for _, r := range repos {
+		for _, dep := range graph[r.Name] {
+			if _, ok := graph[dep]; !ok {
+				missing = append(missing, fmt.Sprintf("%s requires %s", r.Name, dep))
+			}
+		}
+	}
+
+	cycles := findCycles(graph)
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"dependencies": graph, "missing": missing, "cycles": cycles})
+	} else {
+		for _, r := range repos {
+			if len(graph[r.Name]) == 0 {
+				fmt.Printf("%s (no dependencies)\n", r.Name)
+				continue
+			}
+			fmt.Printf("%s -> %s\n", r.Name, strings.Join(graph[r.Name], ", "))
+		}
+
+		if len(missing) > 0 {
+			fmt.Println("Missing dependencies:")
+			for _, m := range missing {
+				fmt.Printf("  %s, which isn't in staging\n", m)
+			}
+		}
+
+		if len(cycles) > 0 {
+			fmt.Println("Dependency cycles:")
+			for _, cycle := range cycles {
+				fmt.Printf("  %s\n", strings.Join(cycle, " -> "))
+			}
+		}
+	}
+
+	if len(missing) > 0 || len(cycles) > 0 {
+		os.Exit(1)
+	}
+}
+
+// order extensions so that each comes after any of the others it requires, keeping the given order
+// otherwise; only requirements between the extensions given matter
+func orderByDependencies(extensions []string) ([]string, error) {
+	var repos []repo
+	for _, ext := range extensions {
+		repos = append(repos, repo{Name: "extensions/" + ext, Path: fmt.Sprintf("%s/%s", EXTENSIONPATH, ext), Short: ext})
+	}
+
+	graph, err := dependencyGraph(repos)
+	if err != nil {
+		return nil, err
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+
+	state := map[string]int{}
+	var path []string
+	var ordered []string
+
+	var visit func(name string) error
+	visit = func(name string) error {
+		state[name] = visiting
+		path = append(path, name)
+
+		for _, dep := range graph[name] {
+			if _, ok := graph[dep]; !ok {
+				continue
+			}
+
+			switch state[dep] {
+			case visiting:
+				return fmt.Errorf("dependency cycle between extensions: %s -> %s", strings.Join(path, " -> "), dep)
+			case unvisited:
+				if err := visit(dep); err != nil {
+					return err
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[name] = visited
+		ordered = append(ordered, strings.TrimPrefix(name, "extensions/"))
+		return nil
+	}
+
+	for _, r := range repos {
+		if state[r.Name] == unvisited {
+			if err := visit(r.Name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return ordered, nil
+}
+
+// check the extension.json of every valid extension, or only the ones named, parses and has the fields
+// MediaWiki needs to load it, since a broken one only shows up once it's deployed
+func runValidateExtensionJSON(args []string) {
+	validateCmd := flag.NewFlagSet("validate-extension-json", flag.ExitOnError)
+	validateCmd.Parse(args)
+
+	extensions, err := GetValidExtensions()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+	if validateCmd.NArg() > 0 {
+		for _, name := range validateCmd.Args() {
+			if !contains(extensions, name) {
+				ExitWithError(fmt.Errorf("unknown extension %s", name), 1)
+			}
+		}
+		extensions = validateCmd.Args()
+	}
+
+	type validateResult struct {
+		Extension string   `json:"extension"`
+		File      string   `json:"file"`
+		OK        bool     `json:"ok"`
+		Errors    []string `json:"errors,omitempty"`
+	}
+
+	var results []validateResult
+	failed := 0
+
+	for _, ext := range extensions {
+		r := repo{Name: "extensions/" + ext, Path: fmt.Sprintf("%s/%s", EXTENSIONPATH, ext), Short: ext}
+		result := validateResult{Extension: ext, File: r.manifestPath(), Errors: validateManifest(r.manifestPath())}
+		result.OK = len(result.Errors) == 0
+
+		if !result.OK {
+			failed++
+		}
+		results = append(results, result)
+	}
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"pass": failed == 0, "results": results})
+	} else {
+		for _, result := range results {
+			for _, problem := range result.Errors {
+				fmt.Printf("FAIL %s: %s\n", result.File, problem)
+			}
+		}
+
+		if failed > 0 {
+			fmt.Printf("FAIL: %d of %d extension.json files have problems\n", failed, len(results))
+		} else {
+			fmt.Printf("PASS: all %d extension.json files are valid\n", len(results))
+		}
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// every problem with an extension.json which would stop MediaWiki loading it
+func validateManifest(path string) []string {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return []string{"no extension.json, it can't be loaded with wfLoadExtension"}
+	}
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	var manifest map[string]any
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		// point at the line, since that's how the file will be opened to fix it
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			line := 1 + bytes.Count(data[:syntaxErr.Offset], []byte("\n"))
+			return []string{fmt.Sprintf("invalid JSON on line %d: %v", line, err)}
+		}
+		return []string{fmt.Sprintf("invalid JSON: %v", err)}
+	}
+
+	var problems []string
+
+	if name, ok := manifest["name"].(string); !ok || name == "" {
+		problems = append(problems, "missing required field name")
+	}
+
+	switch version := manifest["manifest_version"].(type) {
+	case nil:
+		problems = append(problems, "missing required field manifest_version")
+	case float64:
+		if version != 1 && version != 2 {
+			problems = append(problems, fmt.Sprintf("unsupported manifest_version %v, expected 1 or 2", version))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("manifest_version must be a number, not %#v", version))
+	}
+
+	var typed extensionManifest
+	if err := json.Unmarshal(data, &typed); err != nil {
+		problems = append(problems, fmt.Sprintf("invalid telepedia.deployHooks: %v", err))
+	}
+	for _, hook := range typed.Telepedia.DeployHooks {
+		if err := hook.validate(filepath.Dir(path)); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	return problems
+}
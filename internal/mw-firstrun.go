@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// where state which outlives a single staging tree is kept, unless MW_UTILS_STATE_DIR points somewhere else
+const DEFAULTSTATEDIR = "/var/lib/mediawiki-utils"
+
+// the settings which decide where a deploy reads from and writes to; deploying with a combination of these
+// which hasn't been deployed with before has to be confirmed
+type effectiveSettings struct {
+	StagingPath    string         `json:"staging_path"`
+	ProductionPath string         `json:"production_path"`
+	ExtensionPath  string         `json:"extension_path"`
+	SkinPath       string         `json:"skin_path"`
+	DeployUser     string         `json:"deploy_user"`
+	DeployKey      string         `json:"deploy_key"`
+	Servers        []string       `json:"servers"`
+	SSHPorts       map[string]int `json:"ssh_ports"`
+	// left out when empty, so settings confirmed before these were added don't need confirming again
+	SSHUsers map[string]string `json:"ssh_users,omitempty"`
+	SSHKeys  map[string]string `json:"ssh_keys,omitempty"`
+}
+
+func currentSettings() effectiveSettings {
+	return effectiveSettings{STAGINGPATH, PRODUCTIONPATH, EXTENSIONPATH, SKINPATH, DEPLOYUSER, DEPLOYKEY, ALLSERVERS, SSHPORTS, SSHUSERS, SSHKEYS}
+}
+
+func (s effectiveSettings) hash() string {
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// the built in settings are what we ship, so they never need confirming; package variables are initialized
+// in dependency order, so this sees the defaults before any settings file is loaded
+var DEFAULTSETTINGSHASH = currentSettings().hash()
+
+// where state which outlives a single staging tree is kept
+func stateDir() string {
+	if dir := os.Getenv("MW_UTILS_STATE_DIR"); dir != "" {
+		return dir
+	}
+	return DEFAULTSTATEDIR
+}
+
+// the file the hashes of every combination of settings which has been confirmed are kept in
+func seenSettingsFile() string {
+	return stateDir() + "/seen-settings"
+}
+
+// make sure the first deploy with new settings is what was meant, since a wrong production path in a new
+// settings file would otherwise be deployed over straight away; it has to be confirmed with --yes or at a
+// prompt, and once it is, the same settings aren't asked about again
+func confirmNewSettings(config *DeployConfig) error {
+	settings := currentSettings()
+	hash := settings.hash()
+
+	// a dry run changes nothing, so it's how new settings should be tried out
+	if hash == DEFAULTSETTINGSHASH || config.DryRun {
+		return nil
+	}
+
+	data, err := os.ReadFile(seenSettingsFile())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read %s: %w", seenSettingsFile(), err)
+	}
+	if contains(strings.Fields(string(data)), hash) {
+		return nil
+	}
+
+	if !config.Yes {
+		summary, _ := json.MarshalIndent(settings, "", "  ")
+		fmt.Fprintf(os.Stderr, "This is the first deploy with these settings:\n%s\n", summary)
+
+		if stat, err := os.Stdin.Stat(); err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+			return fmt.Errorf("not deploying with settings which haven't been used before without confirmation, check them with --dry-run and then pass --yes")
+		}
+
+		fmt.Fprintf(os.Stderr, "Deploy with them? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+			return fmt.Errorf("not deploying with settings which haven't been confirmed")
+		}
+	}
+
+	// failing to remember them only means being asked again
+	if err := os.MkdirAll(stateDir(), 0755); err == nil {
+		var file *os.File
+		if file, err = os.OpenFile(seenSettingsFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644); err == nil {
+			_, err = fmt.Fprintln(file, hash)
+			file.Close()
+		}
+	}
+	if err != nil {
+		logf("Could not remember these settings, they'll need confirming again: %v\n", err)
+	}
+
+	return nil
+}
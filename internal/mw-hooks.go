@@ -0,0 +1,54 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// the environment passed to deploy hooks describing what is being deployed
+func hookEnv(config *DeployConfig) []string {
+	return append(os.Environ(),
+		"MW_DEPLOY_HOST="+HOSTNAME,
+		"MW_DEPLOY_SERVERS="+strings.Join(config.Servers, ","),
+		"MW_DEPLOY_EXTENSIONS="+strings.Join(config.UpgradeExtensions, ","),
+		"MW_DEPLOY_SKINS="+strings.Join(config.UpgradeSkins, ","),
+		"MW_DEPLOY_VENDOR="+strconv.FormatBool(config.UpgradeVendor),
+		"MW_DEPLOY_L10N="+strconv.FormatBool(config.L10n),
+		"MW_DEPLOY_MESSAGE="+config.Message,
+	)
+}
+
+// run a deploy hook script with the deploy metadata in its environment
+func runHook(script string, env []string) error {
+	traceCommand(nil, "", script, nil)
+	cmd := exec.Command(script)
+	cmd.Env = env
+	cmd.Stdout = progressOutput()
+	cmd.Stderr = os.Stderr
+
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("hook %s failed: %w", script, err)
+	}
+
+	return nil
+}
+
+// run the post deploy hook, telling it how the deploy went; a failing post hook is reported but
+// doesn't change the outcome of the deploy, which has already happened
+func runPostDeployHook(config *DeployConfig, deployErr error) {
+	env := hookEnv(config)
+
+	if deployErr != nil {
+		env = append(env, "MW_DEPLOY_OUTCOME=failure", "MW_DEPLOY_ERROR="+deployErr.Error())
+	} else {
+		env = append(env, "MW_DEPLOY_OUTCOME=success")
+	}
+
+	logf("Running post-deploy hook: %s\n", config.PostDeployHook)
+	if err := runHook(config.PostDeployHook, env); err != nil {
+		logf("%v\n", err)
+	}
+}
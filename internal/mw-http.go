@@ -0,0 +1,144 @@
+package internal
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// default url used to check that a server is healthy; {server} is replaced with the server name
+const DEFAULTHEALTHCHECKURL = "http://{server}/w/api.php?action=query&meta=siteinfo&format=json"
+
+// default urls requested to warm caches after a deploy; {server} is replaced with the server name
+const DEFAULTWARMCACHEURLS = "http://{server}/wiki/Main_Page"
+
+// how long we wait for a single http request before giving up
+const HTTPTIMEOUT = 10 * time.Second
+
+// how long to wait before the first retry of a failed health check; it doubles with each retry after that
+const HEALTHCHECKBACKOFF = time.Second
+
+// the outcome of health checking a single server, including any retries
+type healthResult struct {
+	Server   string
+	Err      error
+	Attempts int
+	Duration time.Duration
+}
+
+// replace the {server} placeholder in a url template
+func expandServerURL(template string, server string) string {
+	return strings.ReplaceAll(template, "{server}", server)
+}
+
+// check that a server is healthy - it must answer the health check url with a 2xx status
+func checkHealth(server string, urlTemplate string) error {
+	url := expandServerURL(urlTemplate, server)
+	client := &http.Client{Timeout: HTTPTIMEOUT}
+
+	resp, err := client.Get(url)
+	if err != nil {
+		return fmt.Errorf("health check of %s failed: %w", server, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("health check of %s failed: %s returned %s", server, url, resp.Status)
+	}
+
+	return nil
+}
+
+// health check a server, retrying with backoff if it fails since a server may take a moment to recover
+// from a sync
+func checkHealthWithRetries(server string, urlTemplate string, retries int) healthResult {
+	result := healthResult{Server: server}
+	start := time.Now()
+	backoff := HEALTHCHECKBACKOFF
+
+	for {
+		result.Attempts++
+		result.Err = checkHealth(server, urlTemplate)
+		if result.Err == nil || result.Attempts > retries {
+			break
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+
+	result.Duration = time.Since(start)
+	return result
+}
+
+// health check several servers at once, at most parallel at a time
+func checkServersHealth(servers []string, urlTemplate string, retries int, parallel int) []healthResult {
+	results := make([]healthResult, len(servers))
+	sem := make(chan struct{}, max(parallel, 1))
+	var wg sync.WaitGroup
+
+	for i, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = checkHealthWithRetries(server, urlTemplate, retries)
+		}()
+	}
+
+	wg.Wait()
+	return results
+}
+
+// print a table of health check results along with whichever server took the longest to answer
+func printHealthResults(results []healthResult) {
+	if len(results) == 0 {
+		return
+	}
+
+	w := tabwriter.NewWriter(progressOutput(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tHEALTH\tATTEMPTS\tTIME")
+
+	slowest := results[0]
+	for _, result := range results {
+		status := "ok"
+		if result.Err != nil {
+			status = "FAILED: " + result.Err.Error()
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", result.Server, status, result.Attempts, result.Duration.Round(time.Millisecond))
+
+		if result.Duration > slowest.Duration {
+			slowest = result
+		}
+	}
+	w.Flush()
+
+	logf("Slowest to respond: %s (%s)\n", slowest.Server, slowest.Duration.Round(time.Millisecond))
+}
+
+// request each url on each server so the first real visitors don't hit cold caches; failures here
+// don't fail the deploy, they're only reported
+func warmCaches(servers []string, urlTemplates []string) {
+	client := &http.Client{Timeout: HTTPTIMEOUT}
+
+	for _, server := range servers {
+		for _, template := range urlTemplates {
+			url := expandServerURL(template, server)
+			start := time.Now()
+
+			resp, err := client.Get(url)
+			if err != nil {
+				logf("  -> [%s] %s failed after %s: %v\n", server, url, time.Since(start).Round(time.Millisecond), err)
+				continue
+			}
+			resp.Body.Close()
+
+			logf("  -> [%s] %s %s in %s\n", server, url, resp.Status, time.Since(start).Round(time.Millisecond))
+		}
+	}
+}
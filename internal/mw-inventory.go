@@ -0,0 +1,103 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// the formats --servers-from-file understands: a plain list of names, or a JSON inventory describing how
+// to reach each server
+const (
+	SERVERSFILETEXT = "text"
+	SERVERSFILEJSON = "json"
+)
+
+// a JSON server inventory, e.g.
+//
+//	{"servers": [{"name": "mw3", "roles": ["app"], "ssh_port": 2222, "ssh_user": "deploy", "ssh_key": "/etc/keys/mw3"}]}
+//
+// everything but the name is optional, and falls back to the settings file and flags
+type serverInventory struct {
+	Servers []inventoryServer `json:"servers"`
+}
+
+type inventoryServer struct {
+	Name    string   `json:"name"`
+	Roles   []string `json:"roles"`
+	SSHPort int      `json:"ssh_port"`
+	SSHUser string   `json:"ssh_user"`
+	SSHKey  string   `json:"ssh_key"`
+}
+
+// server names and ssh users are passed to ssh and rsync, so nothing which could be read as an option or
+// another part of user@host:path is allowed
+var inventoryNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// read a JSON server inventory, checking every entry before any of it is used
+func readServerInventory(path string) ([]inventoryServer, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read server inventory: %w", err)
+	}
+
+	var inventory serverInventory
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&inventory); err != nil {
+		return nil, fmt.Errorf("failed to parse server inventory %s: %w", path, err)
+	}
+
+	if len(inventory.Servers) == 0 {
+		return nil, fmt.Errorf("server inventory %s has no servers", path)
+	}
+
+	seen := map[string]bool{}
+	for i, server := range inventory.Servers {
+		switch {
+		case !inventoryNamePattern.MatchString(server.Name):
+			return nil, fmt.Errorf("server %d in %s has an invalid name %q", i+1, path, server.Name)
+		case seen[server.Name]:
+			return nil, fmt.Errorf("server %s is in %s more than once", server.Name, path)
+		case server.SSHPort < 0 || server.SSHPort > 65535:
+			return nil, fmt.Errorf("server %s in %s has an invalid ssh_port %d", server.Name, path, server.SSHPort)
+		case server.SSHUser != "" && !inventoryNamePattern.MatchString(server.SSHUser):
+			return nil, fmt.Errorf("server %s in %s has an invalid ssh_user %q", server.Name, path, server.SSHUser)
+		}
+		seen[server.Name] = true
+
+		for _, role := range server.Roles {
+			if !inventoryNamePattern.MatchString(role) {
+				return nil, fmt.Errorf("server %s in %s has an invalid role %q", server.Name, path, role)
+			}
+		}
+
+		if server.SSHKey != "" {
+			key := os.ExpandEnv(server.SSHKey)
+			if _, err := os.Stat(key); err != nil {
+				return nil, fmt.Errorf("server %s in %s has an invalid ssh_key: %w", server.Name, path, err)
+			}
+			inventory.Servers[i].SSHKey = key
+		}
+	}
+
+	return inventory.Servers, nil
+}
+
+// make a server from an inventory known, along with how to reach it
+func (s inventoryServer) register() {
+	if !contains(ALLSERVERS, s.Name) {
+		ALLSERVERS = append(ALLSERVERS, s.Name)
+	}
+	if s.SSHPort > 0 {
+		SSHPORTS[s.Name] = s.SSHPort
+	}
+	if s.SSHUser != "" {
+		SSHUSERS[s.Name] = s.SSHUser
+	}
+	if s.SSHKey != "" {
+		SSHKEYS[s.Name] = s.SSHKey
+	}
+}
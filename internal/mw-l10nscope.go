@@ -0,0 +1,108 @@
+package internal
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// values for --l10n-scope
+const (
+	L10NSCOPEFULL = "full"
+	L10NSCOPEAUTO = "auto"
+)
+
+// which languages a deploy's localization cache rebuild covers, and why
+type l10nScope struct {
+	// every language, rather than only Langs
+	Full   bool
+	Langs  []string
+	Reason string
+}
+
+// work out which languages need rebuilding from what this deploy pulled; only the languages whose messages
+// changed in an upgraded extension or skin do, unless something which affects every language changed
+func chooseL10nScope(config *DeployConfig) l10nScope {
+	full := func(reason string) l10nScope {
+		return l10nScope{Full: true, Reason: reason}
+	}
+
+	if config.L10nScope != L10NSCOPEAUTO {
+		return full("--l10n-scope=" + config.L10nScope)
+	}
+	if config.UpgradeVendor {
+		return full("vendor was upgraded")
+	}
+	if config.SyncConfig {
+		return full("--config syncs core")
+	}
+	if DRYRUN {
+		return full("nothing was pulled in a dry run")
+	}
+
+	var paths []string
+	for _, ext := range config.UpgradeExtensions {
+		paths = append(paths, fmt.Sprintf("%s/%s", EXTENSIONPATH, ext))
+	}
+	for _, skin := range config.UpgradeSkins {
+		paths = append(paths, fmt.Sprintf("%s/%s", SKINPATH, skin))
+	}
+
+	langs := map[string]bool{}
+	for _, repoPath := range paths {
+		before, ok := config.pulledFrom[repoPath]
+		if !ok {
+			return full(fmt.Sprintf("what changed in %s isn't known", repoPath))
+		}
+
+		changed, err := gitOutput(config.sourcePath(repoPath), "diff", "--name-only", before, "HEAD")
+		if err != nil {
+			return full(fmt.Sprintf("what changed in %s isn't known: %v", repoPath, err))
+		}
+		if changed == "" {
+			continue
+		}
+
+		for _, file := range strings.Split(changed, "\n") {
+			name := path.Base(file)
+			switch {
+			// these can add, remove or move message files, which affects every language
+			case name == "extension.json" || name == "skin.json" || strings.HasSuffix(name, ".i18n.php"):
+				return full(fmt.Sprintf("%s changed in %s", name, repoPath))
+			case !strings.Contains(file, "i18n/") || path.Ext(name) != ".json":
+				continue
+			// every language falls back to English for messages it doesn't have
+			case name == "en.json":
+				return full(fmt.Sprintf("English messages changed in %s", repoPath))
+			// message documentation, which isn't a language anyone reads the wiki in
+			case name == "qqq.json":
+				continue
+			}
+
+			langs[strings.TrimSuffix(name, ".json")] = true
+		}
+	}
+
+	scope := l10nScope{Reason: "only these languages' messages changed"}
+	for lang := range langs {
+		scope.Langs = append(scope.Langs, lang)
+	}
+	sort.Strings(scope.Langs)
+
+	if len(scope.Langs) == 0 {
+		scope.Reason = "no messages changed"
+	}
+	return scope
+}
+
+// describe the scope for the progress output
+func (s l10nScope) String() string {
+	switch {
+	case s.Full:
+		return fmt.Sprintf("every language (%s)", s.Reason)
+	case len(s.Langs) == 0:
+		return fmt.Sprintf("no languages (%s)", s.Reason)
+	}
+	return fmt.Sprintf("%s (%s)", strings.Join(s.Langs, ", "), s.Reason)
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// run php -l on every php file a pull changed in a repo, since a commit which doesn't even parse breaks
+// every page once it's synced; if any fail, the repo is put back to how it was before the pull so the
+// broken code can't be synced, even if the failure is forced through
+func lintPulled(repoPath string, before string) error {
+	// nothing was pulled to lint
+	if DRYRUN {
+		return nil
+	}
+
+	changed, err := gitOutput(repoPath, "diff", "--name-only", "--diff-filter=ACMR", before, "HEAD", "--", "*.php")
+	if err != nil {
+		return fmt.Errorf("failed to find the php files changed in %s: %w", repoPath, err)
+	}
+	if changed == "" {
+		return nil
+	}
+
+	var failures []string
+	for _, file := range strings.Split(changed, "\n") {
+		cmd, ctx, cancel := newCommand(PHPBIN, "-l", file)
+		cmd.Dir = repoPath
+		traceCommand(nil, repoPath, PHPBIN, cmd.Args[1:])
+		out, err := cmd.CombinedOutput()
+		err = checkTimeout(ctx, cmd, err)
+		cancel()
+
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", file, strings.TrimSpace(string(out))))
+		}
+	}
+
+	if len(failures) == 0 {
+		return nil
+	}
+
+	if err := runCommand("git", "-C", repoPath, "reset", "--hard", "--quiet", before); err != nil {
+		return fmt.Errorf("php lint failed in %s and resetting it to %s also failed (%v), fix it manually before syncing:\n%s", repoPath, before, err, strings.Join(failures, "\n"))
+	}
+
+	return fmt.Errorf("php lint failed in %s, it was reset to %s:\n%s", repoPath, before, strings.Join(failures, "\n"))
+}
@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// the exact commits production was deployed at, written by --write-lock and deployed again by --from-lock
+type deployLock struct {
+	WrittenAt  string            `json:"written_at"`
+	Vendor     string            `json:"vendor,omitempty"`
+	Extensions map[string]string `json:"extensions"`
+	Skins      map[string]string `json:"skins"`
+}
+
+// work out what production is deployed at; extensions and skins go by their deployed marker, so any
+// deployed with --no-version-marker are left out, and vendor goes by staging since it's only ever
+// changed there by a deploy
+func currentDeployLock(config *DeployConfig) *deployLock {
+	lock := &deployLock{
+		WrittenAt:  time.Now().UTC().Format(time.RFC3339),
+		Extensions: map[string]string{},
+		Skins:      map[string]string{},
+	}
+
+	if vendor, err := gitOutput(STAGINGPATH+"/vendor", "rev-parse", "HEAD"); err != nil {
+		logf("Leaving vendor out of the lock, its sha isn't known: %v\n", err)
+	} else {
+		lock.Vendor = vendor
+	}
+
+	repos, err := getAllRepos()
+	if err != nil {
+		logf("Leaving extensions and skins out of the lock: %v\n", err)
+	}
+
+	for _, r := range repos {
+		marker, err := readDeployedMarker(r.prodPath(config.ProdExtensionsDir, config.ProdSkinsDir))
+		if err != nil {
+			logf("Leaving %s out of the lock, its deployed sha isn't known: %v\n", r.Name, err)
+			continue
+		}
+
+		if r.IsSkin {
+			lock.Skins[r.Short] = marker.SHA
+		} else {
+			lock.Extensions[r.Short] = marker.SHA
+		}
+	}
+
+	return lock
+}
+
+// write a lock file
+func writeDeployLock(path string, lock *deployLock) error {
+	data, err := json.MarshalIndent(lock, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write lock file: %w", err)
+	}
+
+	return nil
+}
+
+// read a lock file
+func readDeployLock(path string) (*deployLock, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file: %w", err)
+	}
+
+	return parseDeployLock(data, path)
+}
+
+// parse a lock, from a file or from a manifest repo's history
+func parseDeployLock(data []byte, source string) (*deployLock, error) {
+	var lock deployLock
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lock file %s: %w", source, err)
+	}
+
+	return &lock, nil
+}
+
+// the times --rollback-to accepts, in local time unless they say otherwise
+var ROLLBACKTIMEFORMATS = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// the lock to roll back to for --rollback-to, which is either a lock file (from --write-lock, or a
+// deployed.json) or a time, in which case it's whatever the last deploy recorded in the manifest repo at or
+// before then was deployed at
+func rollbackLock(target string, manifestRepo string) (*deployLock, error) {
+	if info, err := os.Stat(target); err == nil && !info.IsDir() {
+		return readDeployLock(target)
+	}
+
+	var at time.Time
+	var err error
+	for _, format := range ROLLBACKTIMEFORMATS {
+		if at, err = time.ParseInLocation(format, target, time.Local); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("--rollback-to %s is neither a lock file nor a time like 2006-01-02 15:04", target)
+	}
+
+	if manifestRepo == "" {
+		return nil, fmt.Errorf("--rollback-to a time needs --record-manifest, the repo deploys were recorded in")
+	}
+
+	commit, err := gitOutput(manifestRepo, "log", "-1", "--format=%H", "--before="+at.Format(time.RFC3339), "--", MANIFESTFILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search the history of %s: %w", manifestRepo, err)
+	}
+	if commit == "" {
+		return nil, fmt.Errorf("no deploy was recorded in %s at or before %s", manifestRepo, at.Format(time.RFC3339))
+	}
+
+	data, err := gitOutput(manifestRepo, "show", commit+":"+MANIFESTFILE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s at %s: %w", MANIFESTFILE, commit, err)
+	}
+
+	return parseDeployLock([]byte(data), fmt.Sprintf("%s at %s", MANIFESTFILE, commit))
+}
+
+// the extensions and skins in a lock, sorted so they deploy in the same order every time
+func (l *deployLock) names() (extensions []string, skins []string) {
+	for ext := range l.Extensions {
+		extensions = append(extensions, ext)
+	}
+	for skin := range l.Skins {
+		skins = append(skins, skin)
+	}
+	sort.Strings(extensions)
+	sort.Strings(skins)
+
+	return extensions, skins
+}
+
+// check a repo out at exactly the commit a lock recorded, fetching it first if we don't have it; a shallow
+// clone is unshallowed since the commit may be older than what it has
+func checkoutLocked(repoPath string, sha string) error {
+	if _, err := gitOutput(repoPath, "cat-file", "-e", sha+"^{commit}"); err != nil {
+		fetchArgs := []string{"-C", repoPath, "fetch", "--quiet", "origin"}
+		if shallow, err := isShallowRepo(repoPath); err == nil && shallow {
+			fetchArgs = append(fetchArgs, "--unshallow")
+		}
+
+		if err := runCommand("git", fetchArgs...); err != nil {
+			return fmt.Errorf("failed to fetch %s to find %s: %w", repoPath, sha, err)
+		}
+	}
+
+	if err := runCommand("git", "-C", repoPath, "checkout", "--quiet", "--detach", sha); err != nil {
+		return fmt.Errorf("failed to check %s out at %s: %w", repoPath, sha, err)
+	}
+
+	return nil
+}
+
+// the file in a --record-manifest repo which records what production is deployed at
+const MANIFESTFILE = "deployed.json"
+
+// write what production is deployed at into a manifest repo and commit it, pushing it if the repo has
+// a remote, so there's a git history of production
+func recordManifest(repoPath string, config *DeployConfig) error {
+	if err := writeDeployLock(repoPath+"/"+MANIFESTFILE, currentDeployLock(config)); err != nil {
+		return err
+	}
+
+	if err := runCommand("git", "-C", repoPath, "add", MANIFESTFILE); err != nil {
+		return fmt.Errorf("failed to stage %s: %w", MANIFESTFILE, err)
+	}
+
+	message := fmt.Sprintf("deploy by %s at %s", deployingUser(), time.Now().UTC().Format(time.RFC3339))
+	if config.Message != "" {
+		message += "\n\n" + config.Message
+	}
+	if err := runCommand("git", "-C", repoPath, "commit", "--quiet", "-m", message); err != nil {
+		return fmt.Errorf("failed to commit %s: %w", MANIFESTFILE, err)
+	}
+
+	remotes, err := gitOutput(repoPath, "remote")
+	if err != nil {
+		return fmt.Errorf("failed to list remotes: %w", err)
+	}
+	if remotes == "" {
+		return nil
+	}
+
+	if err := runCommand("git", "-C", repoPath, "push", "--quiet"); err != nil {
+		return fmt.Errorf("failed to push: %w", err)
+	}
+
+	return nil
+}
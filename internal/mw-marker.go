@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// file written into each deployed extension and skin recording what was deployed
+const DEPLOYEDMARKER = "DEPLOYED_SHA"
+
+// what a deployed marker file records, stored as key=value lines
+type deployedMarker struct {
+	SHA        string
+	DeployedAt string
+	Message    string
+}
+
+// read the deployed marker from a deployed extension or skin directory
+func readDeployedMarker(dir string) (*deployedMarker, error) {
+	file, err := os.Open(strings.TrimSuffix(dir, "/") + "/" + DEPLOYEDMARKER)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	marker := &deployedMarker{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		key, value, _ := strings.Cut(scanner.Text(), "=")
+		switch key {
+		case "sha":
+			marker.SHA = value
+		case "deployed_at":
+			marker.DeployedAt = value
+		case "message":
+			marker.Message = value
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if marker.SHA == "" {
+		return nil, fmt.Errorf("%s/%s has no sha", dir, DEPLOYEDMARKER)
+	}
+
+	return marker, nil
+}
+
+// write the deployed marker for a repo which was just synced from staging into production; it's not a
+// dotfile, so remote syncs carry it along to the other servers
+func writeDeployedMarkerFromRepo(repoPath string, deployedPath string, config *DeployConfig) error {
+	if config.NoVersionMarker || config.DryRun {
+		return nil
+	}
+
+	sha, err := stagingVersion(repoPath)
+	if err != nil {
+		return fmt.Errorf("failed to get deployed sha of %s: %w", repoPath, err)
+	}
+
+	marker := &deployedMarker{SHA: sha, DeployedAt: time.Now().UTC().Format(time.RFC3339), Message: config.Message}
+	return writeDeployedMarker(deployedPath, marker)
+}
+
+// write the deployed marker into a deployed extension or skin directory; it's written to a temporary file
+// and renamed into place so that the old one, which may be hard linked into a backup, is left alone
+func writeDeployedMarker(dir string, marker *deployedMarker) error {
+	content := fmt.Sprintf("sha=%s\ndeployed_at=%s\n", marker.SHA, marker.DeployedAt)
+	if marker.Message != "" {
+		// the file is one key=value per line, so the message has to fit on one
+		content += fmt.Sprintf("message=%s\n", strings.Join(strings.Fields(marker.Message), " "))
+	}
+	path := strings.TrimSuffix(dir, "/") + "/" + DEPLOYEDMARKER
+
+	if err := os.WriteFile(path+".tmp", []byte(content), 0644); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", DEPLOYEDMARKER, dir, err)
+	}
+
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("failed to write %s to %s: %w", DEPLOYEDMARKER, dir, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// the counters carried over from one deploy's metrics to the next, so they only ever go up like
+// Prometheus expects of a counter
+var METRICSCOUNTERS = []string{"deploy_total", "deploy_failures_total"}
+
+// quote a label value the way the Prometheus text format wants it
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// update the --metrics-file with a finished deploy. node_exporter's textfile collector reads whatever is
+// in the file each time it's scraped, so the file is written next to it and renamed over it rather than
+// written in place, and is locked while the counters are read and written so two deploys finishing at
+// once can't lose a count
+func writeMetricsFile(path string, report *DeployReport) error {
+	unlock, err := lockMetricsFile(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	counters, err := readMetricsCounters(path)
+	if err != nil {
+		return fmt.Errorf("failed to read the counters in %s: %w", path, err)
+	}
+	counters["deploy_total"]++
+	if !report.Success {
+		counters["deploy_failures_total"]++
+	}
+
+	var b bytes.Buffer
+	metric := func(name string, kind string, help string) {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+	boolValue := func(v bool) int {
+		if v {
+			return 1
+		}
+		return 0
+	}
+
+	metric("deploy_total", "counter", "Deploys finished from this host.")
+	fmt.Fprintf(&b, "deploy_total %g\n", counters["deploy_total"])
+	metric("deploy_failures_total", "counter", "Deploys from this host which failed.")
+	fmt.Fprintf(&b, "deploy_failures_total %g\n", counters["deploy_failures_total"])
+	metric("deploy_duration_seconds", "gauge", "How long the last deploy took.")
+	fmt.Fprintf(&b, "deploy_duration_seconds %g\n", report.FinishedAt.Sub(report.StartedAt).Seconds())
+	metric("deploy_last_success", "gauge", "Whether the last deploy succeeded.")
+	fmt.Fprintf(&b, "deploy_last_success %d\n", boolValue(report.Success))
+	metric("deploy_last_timestamp_seconds", "gauge", "When the last deploy finished, as a unix timestamp.")
+	fmt.Fprintf(&b, "deploy_last_timestamp_seconds %d\n", report.FinishedAt.Unix())
+
+	// only steps which were run through a deploy step have a duration, the quick checks which are only
+	// recorded don't
+	metric("deploy_step_duration_seconds", "gauge", "How long each step of the last deploy took, per server.")
+	for _, server := range report.Servers {
+		for _, step := range server.Steps {
+			if step.DurationSeconds == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "deploy_step_duration_seconds{server=\"%s\",step=\"%s\",status=\"%s\"} %g\n",
+				metricsLabelEscaper.Replace(server.Server), metricsLabelEscaper.Replace(step.Step), step.Status, step.DurationSeconds)
+		}
+	}
+
+	// the textfile collector only reads files ending in .prom, so it never sees this half written
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write metrics next to %s: %w", path, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b.Bytes()); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write metrics to %s: %w", tmp.Name(), err)
+	}
+	// node_exporter usually runs as its own user, and CreateTemp only lets the owner read it
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to make %s readable: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write metrics to %s: %w", tmp.Name(), err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", path, err)
+	}
+
+	logf("Updated the deploy metrics in %s\n", path)
+	return nil
+}
+
+// take an exclusive lock on a lock file next to the metrics, which the textfile collector ignores since
+// it doesn't end in .prom; the metrics file itself can't be locked as it's replaced on every write
+func lockMetricsFile(path string) (func(), error) {
+	lockPath := path + ".lock"
+	f, err := os.OpenFile(lockPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %w", lockPath, err)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to lock %s: %w", lockPath, err)
+	}
+
+	return func() {
+		syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+		f.Close()
+	}, nil
+}
+
+// read the counters from the metrics the last deploy wrote; a file which isn't there yet starts them at 0
+func readMetricsCounters(path string) (map[string]float64, error) {
+	counters := map[string]float64{}
+	for _, name := range METRICSCOUNTERS {
+		counters[name] = 0
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return counters, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), " ")
+		if _, counter := counters[name]; !ok || !counter {
+			continue
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s has a value of %q which isn't a number", name, value)
+		}
+		counters[name] = n
+	}
+
+	return counters, scanner.Err()
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// what's POSTed to --notify-webhook once a deploy has finished; text is what chat webhooks (e.g. Slack's
+// incoming webhooks) show, the rest is there for anything which wants to act on it
+type deployNotification struct {
+	Text       string   `json:"text"`
+	Outcome    string   `json:"outcome"`
+	Host       string   `json:"host"`
+	User       string   `json:"user"`
+	Message    string   `json:"message,omitempty"`
+	Servers    []string `json:"servers"`
+	Extensions []string `json:"extensions"`
+	Skins      []string `json:"skins"`
+	Error      string   `json:"error,omitempty"`
+	Tolerated  []string `json:"tolerated,omitempty"`
+}
+
+// tell the webhook how the deploy went; a deploy which only succeeded because failures were let through
+// by --force or a --continue-on-*-error flag counts as failed for --notify-on-failure-only. Like the post
+// hook, a notification which can't be sent is reported but doesn't change the outcome of the deploy
+func sendDeployNotification(config *DeployConfig, deployErr error, tolerated []string) {
+	n := deployNotification{
+		Outcome:    "success",
+		Host:       HOSTNAME,
+		User:       deployingUser(),
+		Message:    config.Message,
+		Servers:    config.Servers,
+		Extensions: config.UpgradeExtensions,
+		Skins:      config.UpgradeSkins,
+		Tolerated:  tolerated,
+	}
+
+	switch {
+	case deployErr != nil:
+		n.Outcome, n.Error = "failure", deployErr.Error()
+		n.Text = fmt.Sprintf("Deploy by %s from %s to %s failed: %v", n.User, n.Host, strings.Join(n.Servers, ", "), deployErr)
+	case len(tolerated) > 0:
+		n.Outcome = "forced"
+		n.Text = fmt.Sprintf("Deploy by %s from %s to %s finished, but %d failed steps were forced through", n.User, n.Host, strings.Join(n.Servers, ", "), len(tolerated))
+	default:
+		if config.NotifyFailureOnly {
+			return
+		}
+		n.Text = fmt.Sprintf("Deploy by %s from %s to %s succeeded", n.User, n.Host, strings.Join(n.Servers, ", "))
+	}
+	if n.Message != "" {
+		n.Text += " - " + n.Message
+	}
+
+	body, err := json.Marshal(n)
+	if err != nil {
+		logf("Failed to encode the deploy notification: %v\n", err)
+		return
+	}
+
+	client := &http.Client{Timeout: HTTPTIMEOUT}
+	resp, err := client.Post(config.NotifyWebhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		// the URL of a webhook is usually its secret (e.g. the token in a Slack webhook's path), so only
+		// what went wrong is logged
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		logf("Failed to send the deploy notification: %v\n", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		logf("Failed to send the deploy notification: the webhook returned %s\n", resp.Status)
+		return
+	}
+
+	logf("Sent the deploy notification (%s)\n", n.Outcome)
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// set by the global --json flag; commands then print a single JSON document on stdout and
+// send their progress output to stderr instead
+var JSONOUTPUT bool
+
+// every error is reported with this schema in JSON mode
+type jsonError struct {
+	Error    string `json:"error"`
+	ExitCode int    `json:"exit_code"`
+}
+
+// set from --summary-only; progress output is thrown away and only a summary is printed at the end
+var SUMMARYONLY bool
+
+// where progress output (including the output of the commands we run) goes
+func progressOutput() io.Writer {
+	if SUMMARYONLY || DASHBOARD != nil {
+		return io.Discard
+	}
+	return resultOutput()
+}
+
+// where the results of a command which aren't its JSON document go
+func resultOutput() io.Writer {
+	if JSONOUTPUT {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// print a progress message
+func logf(format string, args ...any) {
+	fmt.Fprintf(progressOutput(), format, args...)
+}
+
+// held while a whole line is written, so lines from concurrent operations never interleave mid-line
+var outputLock sync.Mutex
+
+// a writer which puts a tag in front of every line written through it, e.g. [mw2]; partial lines are
+// held back until they're finished or flushed
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	buf    []byte
+}
+
+func newPrefixWriter(w io.Writer, tag string) *prefixWriter {
+	return &prefixWriter{w: w, prefix: []byte("[" + tag + "] ")}
+}
+
+func (p *prefixWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		if err := p.writeLine(p.buf[:i+1]); err != nil {
+			return len(b), err
+		}
+		p.buf = p.buf[i+1:]
+	}
+
+	return len(b), nil
+}
+
+// write out whatever is left of an unfinished line
+func (p *prefixWriter) Flush() error {
+	if len(p.buf) == 0 {
+		return nil
+	}
+
+	err := p.writeLine(append(p.buf, '\n'))
+	p.buf = nil
+	return err
+}
+
+func (p *prefixWriter) writeLine(line []byte) error {
+	outputLock.Lock()
+	defer outputLock.Unlock()
+
+	_, err := p.w.Write(append(append([]byte{}, p.prefix...), line...))
+	return err
+}
+
+// the output of one of several operations which may run at once, e.g. syncing to a server, with both its
+// progress messages and the output of the commands it runs tagged; nil means untagged output
+type taggedOutput struct {
+	stdout *prefixWriter
+	stderr *prefixWriter
+}
+
+func newTaggedOutput(tag string) *taggedOutput {
+	return &taggedOutput{
+		stdout: newPrefixWriter(progressOutput(), tag),
+		stderr: newPrefixWriter(os.Stderr, tag),
+	}
+}
+
+// where progress output and the output of commands goes
+func (t *taggedOutput) Stdout() io.Writer {
+	if t == nil {
+		return progressOutput()
+	}
+	return t.stdout
+}
+
+// where the error output of commands goes
+func (t *taggedOutput) Stderr() io.Writer {
+	if t == nil {
+		return os.Stderr
+	}
+	return t.stderr
+}
+
+// print a progress message
+func (t *taggedOutput) logf(format string, args ...any) {
+	fmt.Fprintf(t.Stdout(), format, args...)
+}
+
+// every warning given so far, which --strict turns into a failure
+var (
+	WARNINGS     []string
+	warningsLock sync.Mutex
+)
+
+// print a warning and record it
+func warnf(format string, args ...any) {
+	(*taggedOutput)(nil).warnf(format, args...)
+}
+
+// print a warning tagged with what it's about and record it
+func (t *taggedOutput) warnf(format string, args ...any) {
+	warning := fmt.Sprintf(format, args...)
+
+	warningsLock.Lock()
+	WARNINGS = append(WARNINGS, warning)
+	warningsLock.Unlock()
+
+	t.logf("Warning: %s\n", warning)
+}
+
+// how many warnings have been given so far
+func warningCount() int {
+	warningsLock.Lock()
+	defer warningsLock.Unlock()
+	return len(WARNINGS)
+}
+
+// write out any unfinished lines, once the operation is done
+func (t *taggedOutput) Flush() {
+	if t == nil {
+		return
+	}
+	t.stdout.Flush()
+	t.stderr.Flush()
+}
+
+// print a value as JSON on stdout
+func printJSON(v any) {
+	out, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		ExitWithError(fmt.Errorf("failed to encode JSON output: %w", err), 1)
+	}
+	fmt.Println(string(out))
+}
+
+// report an error in the right format for the output mode and exit
+func ExitWithError(err error, code int) {
+	if JSONOUTPUT {
+		printJSON(jsonError{Error: err.Error(), ExitCode: code})
+	} else {
+		log.Print(err)
+	}
+	os.Exit(code)
+}
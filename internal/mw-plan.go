@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// why an extension or skin was or wasn't selected for upgrade, shown with --explain
+type selection struct {
+	Name     string `json:"name"`
+	IsSkin   bool   `json:"is_skin"`
+	Selected bool   `json:"selected"`
+	Reason   string `json:"reason"`
+}
+
+// work out everything a deploy will do from its flags, the way the deploy itself does before it starts:
+// which extensions and skins are upgraded, in what order, and whether the flags make sense together;
+// nothing is changed, so it's safe for utils deploy-what-if too
+func planDeploy(config *DeployConfig) ([]selection, error) {
+	// these need to be known before --upgrade-world can expand to them; a vendor only deploy doesn't look
+	// at any, and walking every extension and skin is the slow part of starting a deploy
+	if !config.VendorOnly {
+		var extErr, skinErr error
+		VALIDEXTENSIONS, extErr = GetValidExtensions()
+		VALIDSKINS, skinErr = GetValidSkins()
+
+		// either path is only needed if the deploy touches that kind, e.g. a missing skin path doesn't
+		// matter to an extension only deploy
+		if extErr != nil && (config.UpgradeWorld || len(config.UpgradeExtensions) > 0) {
+			return nil, withExitCode(EXITCONFIG, extErr)
+		}
+		if skinErr != nil && (config.UpgradeWorld || len(config.UpgradeSkins) > 0) {
+			return nil, withExitCode(EXITCONFIG, skinErr)
+		}
+	}
+
+	// nothing stops a directory being in both, but it's almost always a symlink mistake
+	for _, name := range nameCollisions(VALIDEXTENSIONS, VALIDSKINS) {
+		warnf("%s is both an extension (%s) and a skin (%s), make sure you're deploying the one you mean", name, filepath.Join(EXTENSIONPATH, name), filepath.Join(SKINPATH, name))
+	}
+
+	// a wrong path would otherwise turn --upgrade-world or all into a no-op which reports success
+	if (config.UpgradeWorld || contains(config.UpgradeExtensions, "all")) && len(VALIDEXTENSIONS) == 0 {
+		return nil, withExitCode(EXITCONFIG, fmt.Errorf("no extensions found at %s - is the path correct?", EXTENSIONPATH))
+	}
+
+	if (config.UpgradeWorld || contains(config.UpgradeSkins, "all")) && len(VALIDSKINS) == 0 {
+		return nil, withExitCode(EXITCONFIG, fmt.Errorf("no skins found at %s - is the path correct?", SKINPATH))
+	}
+
+	// this has to see the flags as they were passed, before --upgrade-world and all are expanded
+	if err := validateFlagCombinations(config); err != nil {
+		return nil, withExitCode(EXITCONFIG, err)
+	}
+
+	selections, err := resolveSelection(config)
+	if err != nil {
+		return nil, withExitCode(EXITGIT, err)
+	}
+
+	// validate our config is valid first before we do anything
+	if err := validateConfig(config); err != nil {
+		return nil, withExitCode(EXITCONFIG, err)
+	}
+
+	// dependencies have to be in place before anything which requires them, unless the operator has
+	// said exactly what order they want with --ordered
+	ordered, err := orderByDependencies(config.UpgradeExtensions)
+	if err != nil && !config.Ordered {
+		return nil, withExitCode(EXITCONFIG, err)
+	}
+	if err == nil && strings.Join(ordered, ",") != strings.Join(config.UpgradeExtensions, ",") {
+		if config.Ordered {
+			warnf("deploying extensions in the given order, even though their dependencies would order them: %s", strings.Join(ordered, ", "))
+		} else {
+			logf("Reordered extensions by their dependencies: %s\n", strings.Join(ordered, ", "))
+			config.UpgradeExtensions = ordered
+		}
+	}
+
+	return selections, nil
+}
+
+// work out which extensions and skins are being upgraded, applying --upgrade-world, --only and
+// --only-changed-repos to the explicitly requested lists, and record why each valid extension and skin was or wasn't selected
+func resolveSelection(config *DeployConfig) ([]selection, error) {
+	explicitExtensions := config.UpgradeExtensions
+	explicitSkins := config.UpgradeSkins
+
+	// --upgrade-world is a helper to do everything
+	if config.UpgradeWorld {
+		config.UpgradeExtensions = VALIDEXTENSIONS
+		config.UpgradeSkins = VALIDSKINS
+		config.UpgradeVendor = true
+		config.L10n = true
+		config.IgnoreTime = true
+	}
+
+	// all only expands the one list, unlike --upgrade-world it doesn't bring vendor or l10n along
+	if contains(config.UpgradeExtensions, "all") {
+		config.UpgradeExtensions = VALIDEXTENSIONS
+	}
+	if contains(config.UpgradeSkins, "all") {
+		config.UpgradeSkins = VALIDSKINS
+	}
+
+	// --only keeps the rest of --upgrade-world but narrows it to a subset of extensions and skins
+	if len(config.Only) > 0 {
+		config.UpgradeExtensions = filterList(config.UpgradeExtensions, config.Only)
+		config.UpgradeSkins = filterList(config.UpgradeSkins, config.Only)
+	}
+
+	// --only-changed-repos narrows whatever was selected to what has something new to deploy
+	if config.OnlyChangedRepos {
+		config.unchanged = map[string]bool{}
+
+		var err error
+		if config.UpgradeExtensions, err = filterChanged(config.UpgradeExtensions, EXTENSIONPATH, "extension", config); err != nil {
+			return nil, err
+		}
+		if config.UpgradeSkins, err = filterChanged(config.UpgradeSkins, SKINPATH, "skin", config); err != nil {
+			return nil, err
+		}
+	}
+
+	var selections []selection
+	for _, ext := range VALIDEXTENSIONS {
+		selections = append(selections, explainSelection(config, ext, false, explicitExtensions))
+	}
+	for _, skin := range VALIDSKINS {
+		selections = append(selections, explainSelection(config, skin, true, explicitSkins))
+	}
+
+	return selections, nil
+}
+
+// work out why a single extension or skin was or wasn't selected
+func explainSelection(config *DeployConfig, name string, isSkin bool, explicit []string) selection {
+	s := selection{Name: name, IsSkin: isSkin}
+
+	kind := "extension"
+	if isSkin {
+		kind = "skin"
+	}
+
+	switch {
+	case config.unchanged[kind+":"+name] && config.SinceCommit != "":
+		s.Reason = fmt.Sprintf("skipped (no changes since %s)", config.SinceCommit)
+	case config.unchanged[kind+":"+name]:
+		s.Reason = "skipped (nothing new to pull)"
+	case config.UpgradeWorld && len(config.Only) > 0 && !contains(config.Only, name):
+		s.Reason = "skipped (not in --only)"
+	case config.UpgradeWorld:
+		s.Selected, s.Reason = true, "selected (upgrade-world)"
+	case contains(explicit, "all"):
+		s.Selected, s.Reason = true, "selected (all)"
+	case config.RollbackTo != "" && contains(explicit, name):
+		s.Selected, s.Reason = true, "selected (rollback)"
+	case config.Lock != nil && contains(explicit, name):
+		s.Selected, s.Reason = true, "selected (from-lock)"
+	case contains(explicit, name):
+		s.Selected, s.Reason = true, "selected (explicit)"
+	default:
+		s.Reason = "skipped (not requested)"
+	}
+
+	return s
+}
+
+// print why each extension and skin was or wasn't selected
+func printSelection(selections []selection) {
+	w := tabwriter.NewWriter(progressOutput(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TYPE\tNAME\tREASON")
+
+	for _, s := range selections {
+		kind := "extension"
+		if s.IsSkin {
+			kind = "skin"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", kind, s.Name, s.Reason)
+	}
+
+	w.Flush()
+}
+
+// what rsync reported it would change during a --dry-run, per source and destination
+type rsyncPlan struct {
+	mu      sync.Mutex
+	entries []rsyncPlanEntry
+}
+
+type rsyncPlanEntry struct {
+	Src     string
+	Dst     string
+	Changes []string
+}
+
+// the changes every rsync of this deploy would have made
+var DRYRUNPLAN = &rsyncPlan{}
+
+// record the --itemize-changes output of a dry run rsync
+func (p *rsyncPlan) add(src string, dst string, output string) {
+	var changes []string
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			changes = append(changes, line)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entries = append(p.entries, rsyncPlanEntry{Src: src, Dst: dst, Changes: changes})
+}
+
+// print every change rsync would have made, grouped by what would have been synced
+func (p *rsyncPlan) print() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	logf("Dry run, rsync would make these changes:\n")
+	for _, entry := range p.entries {
+		if len(entry.Changes) == 0 {
+			logf("%s -> %s: no changes\n", entry.Src, entry.Dst)
+			continue
+		}
+
+		logf("%s -> %s: %d changes\n", entry.Src, entry.Dst, len(entry.Changes))
+		for _, change := range entry.Changes {
+			logf("  %s\n", change)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// how release directories are named, so they sort by when they were made
+const RELEASETIMEFORMAT = BACKUPTIMEFORMAT
+
+// where --releases keeps its releases; next to production rather than in it, so that --config doesn't
+// sync them
+func releasesPath() string {
+	return PRODUCTIONPATH + "-releases"
+}
+
+// the release production points at; with --releases production has to be a symlink to one
+func activeRelease() (string, error) {
+	target, err := os.Readlink(PRODUCTIONPATH)
+	if err != nil {
+		// named like a release, so it's pruned like one once it's old enough
+		initial := filepath.Join(releasesPath(), time.Now().Format(RELEASETIMEFORMAT))
+		return "", fmt.Errorf("%s must be a symlink to a release in %s, move it to %s and symlink it back to start using releases: %w", PRODUCTIONPATH, releasesPath(), initial, err)
+	}
+
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(PRODUCTIONPATH), target)
+	}
+	return filepath.Clean(target), nil
+}
+
+// make a new release from the active one, copied the same way as a --backup so it usually only takes up
+// space for what the deploy changes; everything local is synced into it and it's only made live at the end
+func prepareRelease(config *DeployConfig) error {
+	active, err := activeRelease()
+	if err != nil {
+		return err
+	}
+
+	release := filepath.Join(releasesPath(), time.Now().Format(RELEASETIMEFORMAT))
+	if _, err := os.Stat(release); err == nil {
+		return fmt.Errorf("release %s already exists", release)
+	}
+
+	// production can point at a release which isn't in the releases directory, e.g. the one it was moved
+	// to before starting to use releases
+	if !DRYRUN {
+		if err := os.MkdirAll(releasesPath(), 0755); err != nil {
+			return fmt.Errorf("failed to create release directory: %w", err)
+		}
+	}
+	if err := runCommand("cp", snapshotCopyFlags(config), active, release); err != nil {
+		return fmt.Errorf("failed to make release %s from %s: %w", release, active, err)
+	}
+
+	// rsync shows what would change against the live tree, which is what the release would start as
+	if DRYRUN {
+		return nil
+	}
+
+	for _, file := range BACKUPCOPIEDFILES {
+		if err := unlinkCopy(release + "/" + file); err != nil {
+			os.RemoveAll(release)
+			return fmt.Errorf("failed to copy %s into release %s: %w", file, release, err)
+		}
+	}
+
+	config.release = release
+	logf("Deploying into release %s\n", release)
+	return nil
+}
+
+// where local production work goes: the release being made with --releases, otherwise production itself
+func (c *DeployConfig) localProduction() string {
+	if c.release != "" {
+		return c.release
+	}
+	return PRODUCTIONPATH
+}
+
+// point production at a release; the new symlink is made next to it and renamed over it, so anything
+// reading production sees either the old release or the new one and never neither
+func activateRelease(release string) error {
+	next := PRODUCTIONPATH + ".next"
+	os.Remove(next)
+
+	if err := os.Symlink(release, next); err != nil {
+		return fmt.Errorf("failed to link %s to %s: %w", next, release, err)
+	}
+	if err := os.Rename(next, PRODUCTIONPATH); err != nil {
+		os.Remove(next)
+		return fmt.Errorf("failed to point %s at %s: %w", PRODUCTIONPATH, release, err)
+	}
+
+	return nil
+}
+
+// remove a release this deploy made but never made live, e.g. because syncing into it failed
+func discardRelease(config *DeployConfig) {
+	if config.release == "" {
+		return
+	}
+	if active, err := activeRelease(); err == nil && active == config.release {
+		return
+	}
+
+	logf("Removing release %s, which was never made live\n", config.release)
+	if err := os.RemoveAll(config.release); err != nil {
+		logf("Failed to remove release %s: %v\n", config.release, err)
+	}
+}
+
+// list the releases, oldest first
+func listReleases() ([]string, error) {
+	entries, err := os.ReadDir(releasesPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var releases []string
+	for _, entry := range entries {
+		if entry.IsDir() {
+			releases = append(releases, entry.Name())
+		}
+	}
+	sort.Strings(releases)
+
+	return releases, nil
+}
+
+// remove the oldest releases until only keep are left, never removing the one production points at
+func pruneReleases(keep int) error {
+	releases, err := listReleases()
+	if err != nil {
+		return err
+	}
+	active, err := activeRelease()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range releases[:max(len(releases)-keep, 0)] {
+		path := filepath.Join(releasesPath(), name)
+		if path == active {
+			continue
+		}
+
+		logf("Removing old release %s\n", path)
+		if err := os.RemoveAll(path); err != nil {
+			return fmt.Errorf("failed to remove release %s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// point local production at another release, e.g. the one before a bad deploy, or list the releases if
+// none is given
+func runSwitchRelease(args []string) {
+	switchCmd := flag.NewFlagSet("switch-release", flag.ExitOnError)
+	switchCmd.Parse(args)
+
+	releases, err := listReleases()
+	if err != nil {
+		ExitWithError(fmt.Errorf("failed to list releases: %w", err), 1)
+	}
+	active, activeErr := activeRelease()
+
+	if switchCmd.NArg() == 0 {
+		if JSONOUTPUT {
+			printJSON(map[string]any{"releases": releases, "active": filepath.Base(active)})
+			return
+		}
+
+		if len(releases) == 0 {
+			fmt.Printf("No releases in %s\n", releasesPath())
+			return
+		}
+
+		fmt.Println("Releases:")
+		for _, name := range releases {
+			if filepath.Join(releasesPath(), name) == active {
+				fmt.Printf("  %s (active)\n", name)
+			} else {
+				fmt.Printf("  %s\n", name)
+			}
+		}
+		return
+	}
+
+	if activeErr != nil {
+		ExitWithError(activeErr, 1)
+	}
+
+	name := switchCmd.Arg(0)
+	if !contains(releases, name) {
+		ExitWithError(fmt.Errorf("no release %s in %s", name, releasesPath()), 1)
+	}
+
+	release := filepath.Join(releasesPath(), name)
+	if err := activateRelease(release); err != nil {
+		ExitWithError(err, 1)
+	}
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"active": name, "previous": filepath.Base(active)})
+		return
+	}
+
+	fmt.Printf("Switched %s from %s to %s; this only changed this server, use deploy --push-only <server> --config to switch the others\n", PRODUCTIONPATH, filepath.Base(active), name)
+}
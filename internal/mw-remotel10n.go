@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// how remote servers get their localization cache once the local one has been rebuilt with --l10n:
+// none leaves them to it, rebuild runs rebuildLocalisationCache.php on each of them over ssh, and
+// sync copies the cache built here to them
+const (
+	REMOTEL10NNONE    = "none"
+	REMOTEL10NREBUILD = "rebuild"
+	REMOTEL10NSYNC    = "sync"
+)
+
+// default directory, relative to PRODUCTIONPATH, the localization cache is built in ($wgCacheDirectory)
+const DEFAULTL10NCACHEDIR = "cache/l10n"
+
+// the merged list of extension message files every server's rebuild reads, relative to PRODUCTIONPATH
+const EXTENSIONMESSAGEFILES = "config/ExtensionMessageFiles.php"
+
+// bring a remote server's localization cache up to date, the way --remote-l10n says to
+func updateRemoteL10n(server string, config *DeployConfig) error {
+	out := newTaggedOutput(server)
+	defer out.Flush()
+
+	// the merged message file list is only rebuilt here, but every server's cache is built from it
+	baseArgs := remoteRsyncArgs(server, config)
+	src := fmt.Sprintf("%s/%s", PRODUCTIONPATH, EXTENSIONMESSAGEFILES)
+	dst := fmt.Sprintf("%s:%s/%s", sshTarget(server), PRODUCTIONPATH, EXTENSIONMESSAGEFILES)
+	out.logf("-> Syncing %s to %s...\n", EXTENSIONMESSAGEFILES, server)
+	if err := runRsync(out, baseArgs, src, dst); err != nil {
+		return err
+	}
+
+	switch config.RemoteL10n {
+	case REMOTEL10NSYNC:
+		src := fmt.Sprintf("%s/%s/", PRODUCTIONPATH, config.L10nCacheDir)
+		dst := fmt.Sprintf("%s:%s/%s/", sshTarget(server), PRODUCTIONPATH, config.L10nCacheDir)
+		out.logf("-> Syncing localization cache to %s...\n", server)
+		return runRsync(out, baseArgs, src, dst)
+	case REMOTEL10NREBUILD:
+		remote := fmt.Sprintf("%s %s --quiet --wiki=metawiki", shellWord(PHPBIN), shellWord(PRODUCTIONPATH+"/maintenance/rebuildLocalisationCache.php"))
+		if config.Lang != "" {
+			remote += " " + shellWord("--lang="+config.Lang)
+		} else if scope := config.l10nScope; scope != nil && !scope.Full {
+			// rebuild the same languages as were rebuilt here
+			if len(scope.Langs) == 0 {
+				return nil
+			}
+			remote += " " + shellWord("--lang="+strings.Join(scope.Langs, ","))
+		}
+
+		out.logf("-> Rebuilding localization cache on %s...\n", server)
+		args := append(sshArgs(server), sshTarget(server), remote)
+		if err := runCommandOut(out, "", "ssh", args...); err != nil {
+			return fmt.Errorf("failed to rebuild l10n cache on %s: %w", server, err)
+		}
+	}
+
+	return nil
+}
+
+// whether rebuilding the localization cache here failed (and was carried on past), in which case there's
+// nothing good to give the remote servers
+func localL10nFailed(results []*ServerResult) bool {
+	local := resultFor(results, HOSTNAME)
+	return local != nil && local.stepFailed("l10n")
+}
@@ -0,0 +1,361 @@
+package internal
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// the outcome of a single step of a deploy on a server, e.g. updating an extension
+type StepResult struct {
+	Step       string
+	Err        error
+	Skipped    bool
+	SkipReason string
+	// how long the step ran for, if it was run through a deploy step rather than only recorded
+	Duration time.Duration
+}
+
+// every step that was run against a single server, in the order they ran
+type ServerResult struct {
+	Server string
+	Steps  []StepResult
+	// deployed to and health checked on its own before any other remote server
+	Canary bool
+}
+
+// record the outcome of a step against this server
+func (r *ServerResult) record(step string, err error) {
+	r.Steps = append(r.Steps, StepResult{Step: step, Err: err})
+
+	if err != nil {
+		DEPLOYLOG.step(r.Server, step, "failed", err)
+		DASHBOARD.set(r.Server, step, "failed")
+	} else {
+		DEPLOYLOG.step(r.Server, step, "ok", nil)
+		DASHBOARD.set(r.Server, step, "done")
+	}
+}
+
+// record the outcome of a step along with how long it took
+func (r *ServerResult) recordTimed(step string, err error, took time.Duration) {
+	r.record(step, err)
+	r.Steps[len(r.Steps)-1].Duration = took
+}
+
+// record that a step was skipped and why, e.g. since a previous deploy already completed it
+func (r *ServerResult) skip(step string, reason string) {
+	r.Steps = append(r.Steps, StepResult{Step: step, Skipped: true, SkipReason: reason})
+	DEPLOYLOG.step(r.Server, step, "skipped", nil)
+	DASHBOARD.set(r.Server, step, "skipped")
+}
+
+// whether a specific step failed on this server
+func (r *ServerResult) stepFailed(step string) bool {
+	for _, s := range r.Steps {
+		if s.Step == step && s.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// a server failed if any of its steps failed
+func (r *ServerResult) Failed() bool {
+	for _, step := range r.Steps {
+		if step.Err != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// create an empty result for each server we are deploying to
+func newServerResults(servers []string) []*ServerResult {
+	results := make([]*ServerResult, 0, len(servers))
+	for _, server := range servers {
+		results = append(results, &ServerResult{Server: server})
+	}
+	return results
+}
+
+// find the result for a specific server
+func resultFor(results []*ServerResult, server string) *ServerResult {
+	for _, r := range results {
+		if r.Server == server {
+			return r
+		}
+	}
+	return nil
+}
+
+// count how many servers had at least one failed step
+func countFailedServers(results []*ServerResult) int {
+	failed := 0
+	for _, r := range results {
+		if r.Failed() {
+			failed++
+		}
+	}
+	return failed
+}
+
+// print a table of every step on every server and whether it succeeded
+func printResults(results []*ServerResult) {
+	w := tabwriter.NewWriter(progressOutput(), 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SERVER\tSTEP\tSTATUS")
+
+	for _, r := range results {
+		name := r.Server
+		if r.Canary {
+			name += " (canary)"
+		}
+
+		if len(r.Steps) == 0 {
+			fmt.Fprintf(w, "%s\t-\tnot attempted\n", name)
+			continue
+		}
+
+		for _, step := range r.Steps {
+			status := "ok"
+			if step.Err != nil {
+				status = "FAILED: " + step.Err.Error()
+			} else if step.Skipped {
+				status = "skipped (" + step.SkipReason + ")"
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", name, step.Step, status)
+		}
+	}
+
+	w.Flush()
+}
+
+// a machine readable summary of a deploy, used for --report-format
+type DeployReport struct {
+	StartedAt  time.Time      `json:"started_at"`
+	FinishedAt time.Time      `json:"finished_at"`
+	Success    bool           `json:"success"`
+	Message    string         `json:"message,omitempty"`
+	Error      string         `json:"error,omitempty"`
+	Servers    []ServerReport `json:"servers"`
+	// what rsync transferred in total, with --stats
+	Transferred *RsyncStats `json:"transferred,omitempty"`
+}
+
+type ServerReport struct {
+	Server string       `json:"server"`
+	Canary bool         `json:"canary,omitempty"`
+	Failed bool         `json:"failed"`
+	Steps  []StepReport `json:"steps"`
+	// what rsync transferred to this server, with --stats
+	Transferred *RsyncStats `json:"transferred,omitempty"`
+}
+
+type StepReport struct {
+	Step            string  `json:"step"`
+	Status          string  `json:"status"`
+	Error           string  `json:"error,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds,omitempty"`
+}
+
+// build a report from the results of a deploy
+func newDeployReport(results []*ServerResult, startedAt time.Time, finishedAt time.Time, deployErr error) *DeployReport {
+	report := &DeployReport{
+		StartedAt:  startedAt,
+		FinishedAt: finishedAt,
+		Success:    deployErr == nil,
+		Servers:    []ServerReport{},
+	}
+
+	if deployErr != nil {
+		report.Error = deployErr.Error()
+	}
+
+	for _, r := range results {
+		server := ServerReport{Server: r.Server, Canary: r.Canary, Failed: r.Failed(), Steps: []StepReport{}}
+		for _, step := range r.Steps {
+			stepReport := StepReport{Step: step.Step, Status: "ok", DurationSeconds: step.Duration.Seconds()}
+			if step.Err != nil {
+				stepReport.Status = "failed"
+				stepReport.Error = step.Err.Error()
+			} else if step.Skipped {
+				stepReport.Status = "skipped"
+			}
+			server.Steps = append(server.Steps, stepReport)
+		}
+		report.Servers = append(report.Servers, server)
+	}
+
+	return report
+}
+
+// add what rsync transferred to each server and in total, if it was counted
+func (report *DeployReport) addTransferStats(collector *rsyncStatsCollector) {
+	if collector == nil {
+		return
+	}
+
+	for i := range report.Servers {
+		report.Servers[i].Transferred = collector.forServer(report.Servers[i].Server)
+	}
+	total := collector.total()
+	report.Transferred = &total
+}
+
+// print a summary of a whole deploy for --summary-only, in place of the progress output and results table
+func printSummary(w io.Writer, report *DeployReport) {
+	verdict := "succeeded"
+	if !report.Success {
+		verdict = "failed"
+	}
+	fmt.Fprintf(w, "Deploy %s in %s\n", verdict, report.FinishedAt.Sub(report.StartedAt).Round(time.Second))
+
+	counts := map[string][2]int{}
+	count := func(kind string, status string) {
+		c := counts[kind]
+		if status == "ok" {
+			c[0]++
+		}
+		c[1]++
+		counts[kind] = c
+	}
+
+	var failures []string
+	for _, server := range report.Servers {
+		if server.Canary {
+			verdict := "passed"
+			if server.Failed {
+				verdict = "failed"
+			}
+			fmt.Fprintf(w, "Canary %s: %s\n", server.Server, verdict)
+		}
+
+		for _, step := range server.Steps {
+			switch {
+			case step.Step == "vendor":
+				count("vendor", step.Status)
+			case strings.HasPrefix(step.Step, "extension:"):
+				count("extensions", step.Status)
+			case strings.HasPrefix(step.Step, "skin:"):
+				count("skins", step.Status)
+			case step.Step == "sync" || step.Step == "rsync-local":
+				count("servers", step.Status)
+			}
+
+			if step.Status == "failed" {
+				failures = append(failures, fmt.Sprintf("%s %s: %s", server.Server, step.Step, step.Error))
+			}
+		}
+	}
+
+	labels := [][2]string{{"vendor", "Vendor updated"}, {"extensions", "Extensions updated"}, {"skins", "Skins updated"}, {"servers", "Servers synced"}}
+	for _, label := range labels {
+		if c, ok := counts[label[0]]; ok {
+			fmt.Fprintf(w, "%s: %d of %d\n", label[1], c[0], c[1])
+		}
+	}
+
+	if t := report.Transferred; t != nil {
+		fmt.Fprintf(w, "Transferred: %d files, %s in %d syncs (speedup %.2f)\n", t.FilesTransferred, formatBytes(t.BytesSent+t.BytesReceived), t.Syncs, t.Speedup)
+	}
+
+	if len(failures) > 0 {
+		fmt.Fprintln(w, "Failures:")
+		for _, failure := range failures {
+			fmt.Fprintf(w, "  %s\n", failure)
+		}
+	}
+}
+
+// the subset of the junit xml format that CI systems understand
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      float64         `xml:"time,attr"`
+	Timestamp string          `xml:"timestamp,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// convert a report to junit, with a testsuite per server and a testcase per step
+func (report *DeployReport) toJUnit() junitTestSuites {
+	var suites junitTestSuites
+
+	for _, server := range report.Servers {
+		suite := junitTestSuite{
+			Name:      server.Server,
+			Time:      report.FinishedAt.Sub(report.StartedAt).Seconds(),
+			Timestamp: report.StartedAt.Format(time.RFC3339),
+		}
+
+		for _, step := range server.Steps {
+			testCase := junitTestCase{ClassName: "deploy." + server.Server, Name: step.Step}
+			switch step.Status {
+			case "failed":
+				testCase.Failure = &junitFailure{Message: step.Error, Text: step.Error}
+				suite.Failures++
+			case "skipped":
+				testCase.Skipped = &struct{}{}
+				suite.Skipped++
+			}
+			suite.Cases = append(suite.Cases, testCase)
+		}
+
+		suite.Tests = len(suite.Cases)
+		suites.Suites = append(suites.Suites, suite)
+	}
+
+	return suites
+}
+
+// write the report in the requested format to a file, or stdout if the path is empty
+func writeReport(report *DeployReport, format string, path string) error {
+	var data []byte
+	var err error
+
+	switch format {
+	case "json":
+		data, err = json.MarshalIndent(report, "", "  ")
+	case "junit":
+		data, err = xml.MarshalIndent(report.toJUnit(), "", "  ")
+		data = append([]byte(xml.Header), data...)
+	default:
+		return fmt.Errorf("unknown report format: %s", format)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to build %s report: %w", format, err)
+	}
+
+	data = append(data, '\n')
+
+	if path == "" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,81 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+)
+
+// what each of rsync's exit codes means, from its man page; 255 is ssh failing rather than rsync
+var RSYNCEXITCODES = map[int]string{
+	1:   "syntax or usage error",
+	2:   "protocol incompatibility",
+	3:   "errors selecting input/output files or directories",
+	4:   "requested action not supported",
+	5:   "error starting client-server protocol",
+	10:  "error in socket I/O",
+	11:  "error in file I/O",
+	12:  "error in rsync protocol data stream",
+	13:  "errors with program diagnostics",
+	14:  "error in IPC code",
+	20:  "received SIGUSR1 or SIGINT",
+	21:  "some error returned by waitpid()",
+	22:  "error allocating core memory buffers",
+	23:  "partial transfer due to error",
+	24:  "partial transfer due to vanished source files",
+	25:  "the --max-delete limit stopped deletions",
+	30:  "timeout in data send/receive",
+	35:  "timeout waiting for daemon connection",
+	255: "ssh connection failed",
+}
+
+// returned when rsync exits with an error, carrying its exit code so callers can tell what kind of failure
+// it was
+type RsyncError struct {
+	Code int
+	Src  string
+	Dst  string
+}
+
+func (e *RsyncError) Error() string {
+	meaning, ok := RSYNCEXITCODES[e.Code]
+	if !ok {
+		meaning = "unknown error"
+	}
+	return fmt.Sprintf("rsync of %s to %s failed with exit code %d (%s)", e.Src, e.Dst, e.Code, meaning)
+}
+
+// whether trying the same rsync again could work, i.e. the connection rather than the files was the problem
+func (e *RsyncError) Transient() bool {
+	switch e.Code {
+	case 5, 10, 12, 30, 35, 255:
+		return true
+	}
+	return false
+}
+
+// turn the error of an rsync into an RsyncError if rsync exited with a code, and drop it entirely if it only
+// means some source files vanished while it ran, e.g. a cache file rotated, which is warned about instead
+func checkRsyncError(out *taggedOutput, err error, src, dst string) error {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) || errors.Is(err, ErrTimeout) {
+		return err
+	}
+
+	rsyncErr := &RsyncError{Code: exitErr.ExitCode(), Src: src, Dst: dst}
+	if rsyncErr.Code == 24 {
+		out.warnf("%v, the rest was synced", rsyncErr)
+		return nil
+	}
+
+	return rsyncErr
+}
+
+// whether a failed sync is worth resuming; a timeout is, as is anything rsync puts down to the connection
+func isRetryableRsyncError(err error) bool {
+	var rsyncErr *RsyncError
+	if errors.As(err, &rsyncErr) {
+		return rsyncErr.Transient()
+	}
+	return errors.Is(err, ErrTimeout)
+}
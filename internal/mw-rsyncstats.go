@@ -0,0 +1,159 @@
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
+
+// what rsync's --stats says a sync moved
+type RsyncStats struct {
+	Syncs            int     `json:"syncs"`
+	FilesTransferred int64   `json:"files_transferred"`
+	BytesTransferred int64   `json:"bytes_transferred"`
+	BytesSent        int64   `json:"bytes_sent"`
+	BytesReceived    int64   `json:"bytes_received"`
+	TotalSize        int64   `json:"total_size"`
+	Speedup          float64 `json:"speedup"`
+}
+
+// add another sync's stats to a running total; the speedup is worked out again from the totals, the way
+// rsync does it, rather than averaged
+func (s *RsyncStats) add(other RsyncStats) {
+	s.Syncs += other.Syncs
+	s.FilesTransferred += other.FilesTransferred
+	s.BytesTransferred += other.BytesTransferred
+	s.BytesSent += other.BytesSent
+	s.BytesReceived += other.BytesReceived
+	s.TotalSize += other.TotalSize
+
+	if moved := s.BytesSent + s.BytesReceived; moved > 0 {
+		s.Speedup = float64(s.TotalSize) / float64(moved)
+	}
+}
+
+// the stats of every sync so far, per server; nil unless --stats was passed
+type rsyncStatsCollector struct {
+	mu      sync.Mutex
+	servers map[string]*RsyncStats
+}
+
+// the collector syncs are added to as they finish
+var RSYNCSTATS *rsyncStatsCollector
+
+func newRsyncStatsCollector() *rsyncStatsCollector {
+	return &rsyncStatsCollector{servers: map[string]*RsyncStats{}}
+}
+
+func (c *rsyncStatsCollector) add(server string, stats RsyncStats) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.servers[server] == nil {
+		c.servers[server] = &RsyncStats{}
+	}
+	c.servers[server].add(stats)
+}
+
+// the totals of a single server, if anything was synced to it
+func (c *rsyncStatsCollector) forServer(server string) *RsyncStats {
+	if c == nil {
+		return nil
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if stats, ok := c.servers[server]; ok {
+		copied := *stats
+		return &copied
+	}
+	return nil
+}
+
+// the totals across every server
+func (c *rsyncStatsCollector) total() RsyncStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var total RsyncStats
+	for _, stats := range c.servers {
+		total.add(*stats)
+	}
+	return total
+}
+
+// print what was transferred to each server and in total
+func (c *rsyncStatsCollector) print(w io.Writer) {
+	c.mu.Lock()
+	servers := make([]string, 0, len(c.servers))
+	for server := range c.servers {
+		servers = append(servers, server)
+	}
+	c.mu.Unlock()
+	sort.Strings(servers)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "SERVER\tSYNCS\tFILES\tTRANSFERRED\tSPEEDUP")
+	for _, server := range servers {
+		stats := c.forServer(server)
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%.2f\n", server, stats.Syncs, stats.FilesTransferred, formatBytes(stats.BytesSent+stats.BytesReceived), stats.Speedup)
+	}
+	total := c.total()
+	fmt.Fprintf(tw, "total\t%d\t%d\t%s\t%.2f\n", total.Syncs, total.FilesTransferred, formatBytes(total.BytesSent+total.BytesReceived), total.Speedup)
+	tw.Flush()
+}
+
+// pick the numbers out of the summary rsync prints with --stats; returns false if there wasn't one
+func parseRsyncStats(output string) (RsyncStats, bool) {
+	stats := RsyncStats{Syncs: 1}
+	found := false
+
+	// rsync groups digits with commas, e.g. 1,234,567 bytes
+	number := func(s string) int64 {
+		s, _, _ = strings.Cut(strings.TrimSpace(s), " ")
+		n, _ := strconv.ParseInt(strings.ReplaceAll(s, ",", ""), 10, 64)
+		return n
+	}
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		key, value, ok := strings.Cut(line, ":")
+
+		switch {
+		// older versions of rsync don't say regular
+		case ok && (key == "Number of regular files transferred" || key == "Number of files transferred"):
+			stats.FilesTransferred, found = number(value), true
+		case ok && key == "Total transferred file size":
+			stats.BytesTransferred = number(value)
+		case ok && key == "Total bytes sent":
+			stats.BytesSent = number(value)
+		case ok && key == "Total bytes received":
+			stats.BytesReceived = number(value)
+		case strings.HasPrefix(line, "total size is "):
+			size, speedup, _ := strings.Cut(strings.TrimPrefix(line, "total size is "), "speedup is ")
+			stats.TotalSize = number(size)
+			stats.Speedup, _ = strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(speedup), ",", ""), 64)
+		}
+	}
+
+	return stats, found
+}
+
+// which server an rsync destination is on, e.g. mw2 for deploy@mw2:/srv/mediawiki/; a local path is on this one
+func rsyncDestServer(dst string) string {
+	host, _, remote := strings.Cut(dst, ":")
+	if !remote {
+		return HOSTNAME
+	}
+	if _, after, ok := strings.Cut(host, "@"); ok {
+		return after
+	}
+	return host
+}
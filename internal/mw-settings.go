@@ -0,0 +1,263 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+)
+
+// where settings are loaded from unless MW_UTILS_CONFIG points somewhere else
+const DEFAULTSETTINGSFILE = "/etc/mediawiki-utils/config.json"
+
+// the settings which can be overridden from the settings file; anything left out keeps its default.
+// paths can reference the environment, e.g. ${DEPLOY_ROOT}/staging
+type settingsFile struct {
+	StagingPath     string         `json:"staging_path"`
+	ProductionPath  string         `json:"production_path"`
+	ExtensionPath   string         `json:"extension_path"`
+	SkinPath        string         `json:"skin_path"`
+	DeployUser      string         `json:"deploy_user"`
+	DeployKey       string         `json:"deploy_key"`
+	BackupPath      string         `json:"backup_path"`
+	PHPBin          string         `json:"php_bin"`
+	ComposerBin     string         `json:"composer_bin"`
+	Servers         []string       `json:"servers"`
+	SSHPorts        map[string]int `json:"ssh_ports"`
+	DeployHosts     []string       `json:"deploy_hosts"`
+	BandwidthBudget string         `json:"bandwidth_budget"`
+	ArtifactURL     string         `json:"artifact_url"`
+	// a pointer, so that leaving it out can be told apart from turning it off
+	RequireDeployMessage *bool `json:"require_deploy_message"`
+}
+
+// the settings file which was loaded, if any
+var SETTINGSPATH string
+
+// where each setting which doesn't have its built in default came from, e.g. file, for utils show-config
+var SETTINGSOURCES = map[string]string{}
+
+// load the settings file, if there is one, over the top of the defaults
+func LoadSettings() error {
+	path := os.Getenv("MW_UTILS_CONFIG")
+	explicit := path != ""
+	if !explicit {
+		path = DEFAULTSETTINGSFILE
+	}
+	SETTINGSPATH = path
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		// the default settings file is optional, but one we were explicitly pointed at isn't
+		if errors.Is(err, os.ErrNotExist) && !explicit {
+			SETTINGSPATH = ""
+			return nil
+		}
+		return fmt.Errorf("failed to read settings file: %w", err)
+	}
+
+	var settings settingsFile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&settings); err != nil {
+		return fmt.Errorf("failed to parse settings file %s: %w", path, err)
+	}
+
+	// extensions and skins live in staging unless they're explicitly somewhere else
+	if settings.StagingPath != "" {
+		if STAGINGPATH, err = expandPath(settings.StagingPath); err != nil {
+			return err
+		}
+		EXTENSIONPATH = STAGINGPATH + "/extensions/"
+		SKINPATH = STAGINGPATH + "/skins/"
+		SETTINGSOURCES["staging_path"] = "file"
+		SETTINGSOURCES["extension_path"] = "file (staging_path)"
+		SETTINGSOURCES["skin_path"] = "file (staging_path)"
+	}
+
+	if settings.ProductionPath != "" {
+		if PRODUCTIONPATH, err = expandPath(settings.ProductionPath); err != nil {
+			return err
+		}
+		SETTINGSOURCES["production_path"] = "file"
+	}
+
+	if settings.ExtensionPath != "" {
+		if EXTENSIONPATH, err = expandPath(settings.ExtensionPath); err != nil {
+			return err
+		}
+		SETTINGSOURCES["extension_path"] = "file"
+	}
+
+	if settings.SkinPath != "" {
+		if SKINPATH, err = expandPath(settings.SkinPath); err != nil {
+			return err
+		}
+		SETTINGSOURCES["skin_path"] = "file"
+	}
+
+	if settings.BackupPath != "" {
+		if BACKUPPATH, err = expandPath(settings.BackupPath); err != nil {
+			return err
+		}
+		SETTINGSOURCES["backup_path"] = "file"
+	}
+
+	if settings.DeployKey != "" {
+		if DEPLOYKEY, err = expandPath(settings.DeployKey); err != nil {
+			return err
+		}
+		SETTINGSOURCES["deploy_key"] = "file"
+	}
+
+	if settings.DeployUser != "" {
+		DEPLOYUSER = settings.DeployUser
+		SETTINGSOURCES["deploy_user"] = "file"
+	}
+
+	if settings.PHPBin != "" {
+		PHPBIN = os.ExpandEnv(settings.PHPBin)
+		SETTINGSOURCES["php_bin"] = "file"
+	}
+
+	if settings.ComposerBin != "" {
+		COMPOSERBIN = os.ExpandEnv(settings.ComposerBin)
+		SETTINGSOURCES["composer_bin"] = "file"
+	}
+
+	if len(settings.Servers) > 0 {
+		ALLSERVERS = settings.Servers
+		SETTINGSOURCES["servers"] = "file"
+	}
+
+	if settings.BandwidthBudget != "" {
+		if _, err := parseBytes(settings.BandwidthBudget); err != nil {
+			return fmt.Errorf("invalid bandwidth_budget in settings file: %w", err)
+		}
+		BANDWIDTHBUDGET = settings.BandwidthBudget
+		SETTINGSOURCES["bandwidth_budget"] = "file"
+	}
+
+	if settings.RequireDeployMessage != nil {
+		REQUIREDEPLOYMESSAGE = *settings.RequireDeployMessage
+		SETTINGSOURCES["require_deploy_message"] = "file"
+	}
+
+	if settings.ArtifactURL != "" {
+		ARTIFACTURL = settings.ArtifactURL
+		SETTINGSOURCES["artifact_url"] = "file"
+	}
+
+	if len(settings.DeployHosts) > 0 {
+		DEPLOYHOSTS = settings.DeployHosts
+		SETTINGSOURCES["deploy_hosts"] = "file"
+	}
+
+	for server, port := range settings.SSHPorts {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid ssh port %d for %s in settings file", port, server)
+		}
+		SSHPORTS[server] = port
+		SETTINGSOURCES["ssh_ports"] = "file"
+	}
+
+	return nil
+}
+
+// expand any environment variables in a path from the settings file and make sure it exists
+func expandPath(path string) (string, error) {
+	expanded := os.ExpandEnv(path)
+
+	if _, err := os.Stat(expanded); err != nil {
+		return "", fmt.Errorf("invalid path %s in settings file (expanded to %s): %w", path, expanded, err)
+	}
+
+	return strings.TrimSuffix(expanded, "/"), nil
+}
+
+// print every effective setting and where it came from: its built in default, the settings file, the
+// environment or a deploy flag; takes the same flags as deploy, since some of them override settings
+func runShowConfig(args []string) {
+	config, err := parseFlags(args)
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	type setting struct {
+		Name   string `json:"name"`
+		Value  any    `json:"value"`
+		Source string `json:"source"`
+	}
+
+	source := func(name string) string {
+		if s, ok := SETTINGSOURCES[name]; ok {
+			return s
+		}
+		return "default"
+	}
+
+	// a flag which was given wins over the file
+	fromFlag := func(name string, flagName string, value any, current any) setting {
+		if fmt.Sprint(value) != fmt.Sprint(current) {
+			return setting{name, value, "flag (--" + flagName + ")"}
+		}
+		return setting{name, current, source(name)}
+	}
+
+	// already checked when it was loaded
+	budget, _ := parseBytes(BANDWIDTHBUDGET)
+
+	settingsFile := setting{"settings_file", SETTINGSPATH, "default"}
+	if os.Getenv("MW_UTILS_CONFIG") != "" {
+		settingsFile.Source = "env (MW_UTILS_CONFIG)"
+	} else if SETTINGSPATH == "" {
+		settingsFile.Value = DEFAULTSETTINGSFILE + " (not found, using defaults)"
+	}
+
+	stateDirSource := "default"
+	if os.Getenv("MW_UTILS_STATE_DIR") != "" {
+		stateDirSource = "env (MW_UTILS_STATE_DIR)"
+	}
+
+	// without any, deploys can be run from any of the servers
+	deployHostsSource := source("deploy_hosts")
+	if len(DEPLOYHOSTS) == 0 {
+		deployHostsSource = "default (servers)"
+	}
+
+	settings := []setting{
+		settingsFile,
+		{"staging_path", STAGINGPATH, source("staging_path")},
+		{"production_path", PRODUCTIONPATH, source("production_path")},
+		{"extension_path", EXTENSIONPATH, source("extension_path")},
+		{"skin_path", SKINPATH, source("skin_path")},
+		{"backup_path", BACKUPPATH, source("backup_path")},
+		{"deploy_user", DEPLOYUSER, source("deploy_user")},
+		{"deploy_key", DEPLOYKEY, source("deploy_key")},
+		{"servers", ALLSERVERS, source("servers")},
+		{"deploy_hosts", deployHosts(), deployHostsSource},
+		{"ssh_ports", SSHPORTS, source("ssh_ports")},
+		fromFlag("ssh_port", "ssh-port", config.SSHPort, SSHPORT),
+		fromFlag("php_bin", "php-bin", config.PHPBin, PHPBIN),
+		fromFlag("composer_bin", "composer-bin", config.ComposerBin, COMPOSERBIN),
+		fromFlag("bandwidth_budget", "bandwidth-budget", formatBytes(config.BandwidthBudget), formatBytes(budget)),
+		fromFlag("artifact_url", "artifact-url", config.ArtifactURL, ARTIFACTURL),
+		{"require_deploy_message", REQUIREDEPLOYMESSAGE, source("require_deploy_message")},
+		{"state_dir", stateDir(), stateDirSource},
+	}
+
+	if JSONOUTPUT {
+		printJSON(settings)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SETTING\tVALUE\tSOURCE")
+	for _, s := range settings {
+		fmt.Fprintf(w, "%s\t%v\t%s\n", s.Name, s.Value, s.Source)
+	}
+	w.Flush()
+}
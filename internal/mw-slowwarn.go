@@ -0,0 +1,53 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// say every interval that a step is still running, until it finishes; a step which is slow but still
+// making progress is left to carry on, --git-timeout and --rsync-timeout are what kill one which is stuck.
+// These are only progress, so they aren't recorded as warnings and --strict doesn't fail on them
+func watchSlowStep(server string, step string, interval time.Duration) (stop func()) {
+	done := make(chan struct{})
+	start := time.Now()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				logf("Slow: %s on %s has been running %s, still going...\n", describeStep(step), server, time.Since(start).Round(time.Second))
+			}
+		}
+	}()
+
+	return func() { close(done) }
+}
+
+// a step as an operator would say it, e.g. extension:Echo is the update of extension Echo
+func describeStep(step string) string {
+	kind, name, _ := strings.Cut(step, ":")
+
+	switch kind {
+	case "extension", "skin":
+		return fmt.Sprintf("update of %s %s", kind, name)
+	case "composer":
+		return "composer install of extension " + name
+	case "hooks":
+		return "deploy hooks of extension " + name
+	case "vendor":
+		return "update of vendor"
+	case "rsync-local", "sync":
+		return "rsync"
+	case "l10n":
+		return "localization cache rebuild"
+	}
+
+	return step
+}
@@ -0,0 +1,65 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// the ssh port used for every server which doesn't have its own in SSHPORTS; set from --ssh-port,
+// 0 leaves it to ssh
+var SSHPORT int
+
+// ssh ports for specific servers, set from the settings file
+var SSHPORTS = map[string]int{}
+
+// ssh users and keys for specific servers, set from a JSON server inventory; any server without its own
+// logs in as DEPLOYUSER with DEPLOYKEY
+var SSHUSERS = map[string]string{}
+var SSHKEYS = map[string]string{}
+
+// the user to log in to a server as
+func sshUser(server string) string {
+	if user, ok := SSHUSERS[server]; ok {
+		return user
+	}
+	return DEPLOYUSER
+}
+
+// user@server, for ssh and rsync destinations
+func sshTarget(server string) string {
+	return fmt.Sprintf("%s@%s", sshUser(server), server)
+}
+
+// the ssh port to use for a server, or 0 for ssh's default
+func sshPort(server string) int {
+	if port, ok := SSHPORTS[server]; ok {
+		return port
+	}
+	return SSHPORT
+}
+
+// the ssh options needed to log in to a server as the deploy user; with an agent holding the deploy key,
+// ssh finds it there rather than being given its path
+func sshArgs(server string) []string {
+	// the agent only holds the deploy key, so a server with its own key is always given it
+	var args []string
+	if key, ok := SSHKEYS[server]; ok {
+		args = append(args, "-i", key)
+	} else if !SSHAGENT {
+		args = append(args, "-i", DEPLOYKEY)
+	}
+	if port := sshPort(server); port > 0 {
+		args = append(args, "-p", fmt.Sprint(port))
+	}
+	return args
+}
+
+// the ssh command given to rsync's -e; rsync splits it up itself, so any part which needs it is quoted to keep
+// e.g. a key path with spaces in it as one argument
+func rsyncSSHCommand(server string) string {
+	parts := []string{"ssh"}
+	for _, arg := range sshArgs(server) {
+		parts = append(parts, shellWord(arg))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,175 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// set from --encrypted-key and --ssh-agent; ssh then gets the deploy key from an agent, so its path is
+// never on the command line of ssh or rsync
+var SSHAGENT bool
+
+// how long a decrypted deploy key stays in the agent started for the deploy; the agent dies with the
+// deploy anyway, this is only a backstop
+const SSHAGENTKEYLIFETIME = 4 * time.Hour
+
+// how long to wait for the agent to start listening on its socket
+const SSHAGENTSTARTTIMEOUT = 5 * time.Second
+
+// the private agent started to hold a decrypted deploy key for the length of a deploy. It's started with
+// cat as its command, reading from a pipe only we hold: however we exit, even killed, the pipe closes, cat
+// exits and ssh-agent exits after it, as it does when its command dies. ssh-agent is usually setgid, so
+// the kernel won't kill it for us when we die
+type sshAgent struct {
+	dir     string
+	socket  string
+	cmd     *exec.Cmd
+	stdin   io.WriteCloser
+	signals chan os.Signal
+	once    sync.Once
+}
+
+// decrypt an age or gpg encrypted deploy key, going by its extension; the key is only ever held in memory
+func decryptDeployKey(path string, ageIdentity string) ([]byte, error) {
+	var cmd *exec.Cmd
+	switch filepath.Ext(path) {
+	case ".age":
+		cmd = exec.Command("age", "--decrypt", "-i", ageIdentity, path)
+	case ".gpg", ".asc":
+		cmd = exec.Command("gpg", "--quiet", "--batch", "--decrypt", path)
+	default:
+		return nil, fmt.Errorf("don't know how to decrypt %s, expected a .age, .gpg or .asc file", path)
+	}
+
+	traceCommand(nil, "", cmd.Args[0], cmd.Args[1:])
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	key, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt deploy key %s: %w: %s", path, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	return key, nil
+}
+
+// start an agent of our own and load the decrypted deploy key into it, pointing every ssh we run at it
+func startSSHAgent(encryptedKey string, ageIdentity string) (*sshAgent, error) {
+	key, err := decryptDeployKey(encryptedKey, ageIdentity)
+	if err != nil {
+		return nil, err
+	}
+	defer clear(key)
+
+	// MkdirTemp makes it readable only by us, so nobody else can use the socket in it
+	dir, err := os.MkdirTemp("", "mw-deploy-agent-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a directory for the ssh-agent socket: %w", err)
+	}
+	agent := &sshAgent{dir: dir, socket: filepath.Join(dir, "agent.sock")}
+
+	args := []string{"-a", agent.socket, "cat"}
+	traceCommand(nil, "", "ssh-agent", args)
+	agent.cmd = exec.Command("ssh-agent", args...)
+	if agent.stdin, err = agent.cmd.StdinPipe(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start ssh-agent: %w", err)
+	}
+	if err := agent.cmd.Start(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to start ssh-agent: %w", err)
+	}
+
+	// stop it on ^C or a kill as well, rather than only once the deploy returns
+	agent.signals = make(chan os.Signal, 1)
+	signal.Notify(agent.signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig, ok := <-agent.signals
+		if !ok {
+			return
+		}
+		agent.stop()
+		ExitWithError(fmt.Errorf("deploy interrupted by %v", sig), EXITFAILURE)
+	}()
+
+	deadline := time.Now().Add(SSHAGENTSTARTTIMEOUT)
+	for {
+		if _, err := os.Stat(agent.socket); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			agent.stop()
+			return nil, fmt.Errorf("ssh-agent didn't create its socket %s within %s", agent.socket, SSHAGENTSTARTTIMEOUT)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	// everything we run from here on inherits it, including rsync's ssh
+	os.Setenv("SSH_AUTH_SOCK", agent.socket)
+
+	// given on stdin, so it's never written to disk
+	args = []string{"-q", "-t", strconv.Itoa(int(SSHAGENTKEYLIFETIME.Seconds())), "-"}
+	traceCommand(nil, "", "ssh-add", args)
+	add := exec.Command("ssh-add", args...)
+	add.Stdin = bytes.NewReader(key)
+	if out, err := add.CombinedOutput(); err != nil {
+		agent.stop()
+		return nil, fmt.Errorf("failed to add the deploy key to ssh-agent: %w: %s", err, bytes.TrimSpace(out))
+	}
+
+	SSHAGENT = true
+	return agent, nil
+}
+
+// stop the agent, which takes the deploy key with it; safe to call more than once, e.g. from the signal
+// handler and at the end of the deploy
+func (a *sshAgent) stop() {
+	if a == nil {
+		return
+	}
+
+	a.once.Do(func() {
+		// anything after this is interrupted the usual way again
+		signal.Stop(a.signals)
+		close(a.signals)
+
+		// ssh-agent only notices its command has gone every few seconds, so the key is removed first
+		remove := exec.Command("ssh-add", "-q", "-D")
+		remove.Env = append(os.Environ(), "SSH_AUTH_SOCK="+a.socket)
+		if out, err := remove.CombinedOutput(); err != nil {
+			logf("Failed to remove the deploy key from ssh-agent: %v: %s\n", err, bytes.TrimSpace(out))
+		}
+
+		a.stdin.Close()
+		a.cmd.Wait()
+		os.RemoveAll(a.dir)
+		os.Unsetenv("SSH_AUTH_SOCK")
+	})
+}
+
+// set up where ssh gets the deploy key from for --encrypted-key or --ssh-agent; the agent returned (if one
+// was started) has to be stopped once the deploy is done with ssh
+func setupDeployKey(config *DeployConfig) (*sshAgent, error) {
+	if config.SSHAgent {
+		if os.Getenv("SSH_AUTH_SOCK") == "" {
+			return nil, fmt.Errorf("--ssh-agent needs a running ssh-agent, but SSH_AUTH_SOCK isn't set")
+		}
+		SSHAGENT = true
+		return nil, nil
+	}
+
+	if config.EncryptedKey == "" {
+		return nil, nil
+	}
+
+	logf("Loading the deploy key from %s into ssh-agent\n", config.EncryptedKey)
+	return startSSHAgent(config.EncryptedKey, config.AgeIdentity)
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+)
+
+// where the progress of the last deploy is recorded so that it can be resumed with --resume
+func stateFile() string {
+	return STAGINGPATH + "/.deploy-state.json"
+}
+
+// the steps completed by a deploy; key identifies the deploy so a changed config starts from scratch
+type deployState struct {
+	Key       string   `json:"key"`
+	Completed []string `json:"completed"`
+	// a dry run doesn't complete anything, so it must never touch the state file
+	dryRun bool
+	// remote servers can be synced in parallel
+	mu sync.Mutex
+}
+
+// work out the key for a deploy from everything that decides what it does
+func deployStateKey(config *DeployConfig) string {
+	target, _ := json.Marshal(struct {
+		Extensions []string
+		Skins      []string
+		Vendor     bool
+		L10n       bool
+		Lang       string
+		Servers    []string
+		SyncConfig bool
+	}{config.UpgradeExtensions, config.UpgradeSkins, config.UpgradeVendor, config.L10n, config.Lang, config.Servers, config.SyncConfig})
+
+	sum := sha256.Sum256(target)
+	return hex.EncodeToString(sum[:])
+}
+
+// load the state of the previous deploy if we are resuming it, otherwise start afresh
+func loadDeployState(config *DeployConfig) *deployState {
+	state := &deployState{Key: deployStateKey(config), dryRun: config.DryRun}
+
+	if !config.Resume {
+		return state
+	}
+
+	data, err := os.ReadFile(stateFile())
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logf("Could not read deploy state, starting from scratch: %v\n", err)
+		}
+		return state
+	}
+
+	var previous deployState
+	if err := json.Unmarshal(data, &previous); err != nil {
+		logf("Could not parse deploy state, starting from scratch: %v\n", err)
+		return state
+	}
+
+	if previous.Key != state.Key {
+		logf("Deploy config has changed since the last deploy, starting from scratch\n")
+		return state
+	}
+
+	state.Completed = previous.Completed
+	return state
+}
+
+// check whether a step was already completed
+func (s *deployState) isCompleted(step string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return contains(s.Completed, step)
+}
+
+// record that a step completed successfully
+func (s *deployState) complete(step string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !contains(s.Completed, step) {
+		s.Completed = append(s.Completed, step)
+	}
+	s.save()
+}
+
+// forget every completed sync; once anything in staging has been updated again, everything
+// downstream of it has to be synced again too, even if it was synced before
+func (s *deployState) invalidateSyncs() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var kept []string
+	for _, step := range s.Completed {
+		if isUpdateStep(step) {
+			kept = append(kept, step)
+		}
+	}
+	s.Completed = kept
+	s.save()
+}
+
+// the deploy finished, so there's nothing left to resume
+func (s *deployState) clear() {
+	if s.dryRun {
+		return
+	}
+
+	if err := os.Remove(stateFile()); err != nil && !errors.Is(err, os.ErrNotExist) {
+		logf("Could not remove deploy state: %v\n", err)
+	}
+}
+
+// write the state to disk; failing to do so only means we can't resume, so just warn
+func (s *deployState) save() {
+	if s.dryRun {
+		return
+	}
+
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err == nil {
+		err = os.WriteFile(stateFile(), data, 0644)
+	}
+
+	if err != nil {
+		logf("Could not save deploy state: %v\n", err)
+	}
+}
+
+// update steps are the ones that change staging (as opposed to syncing it somewhere)
+func isUpdateStep(step string) bool {
+	_, name, _ := strings.Cut(step, ":")
+	return name == "vendor" || strings.HasPrefix(name, "extension:") || strings.HasPrefix(name, "skin:") || strings.HasPrefix(name, "composer:")
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// run the rsyncs a deploy would run to a single server, but as a dry run, to check that the key, user,
+// port and excludes all work without changing anything; takes the same flags as deploy to decide what
+// to sync, and syncs the whole MediaWiki root if nothing is chosen
+func runTestRsync(args []string) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		ExitWithError(fmt.Errorf("usage: utils test-rsync <server> [deploy flags]"), 1)
+	}
+
+	server := args[0]
+	if !contains(ALLSERVERS, server) {
+		ExitWithError(fmt.Errorf("unknown server %s, expected one of %v", server, ALLSERVERS), 1)
+	}
+
+	hname, err := getShortHostname()
+	if err != nil {
+		ExitWithError(fmt.Errorf("could not determine hostname: %w", err), 1)
+	}
+	HOSTNAME = hname
+
+	config, err := parseFlags(args[1:])
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	DRYRUN = true
+	SSHPORT = config.SSHPort
+	COMMANDTIMEOUTS["rsync"] = config.RsyncTimeout
+
+	// only what's being tested needs to be there
+	var extErr, skinErr error
+	VALIDEXTENSIONS, extErr = GetValidExtensions()
+	VALIDSKINS, skinErr = GetValidSkins()
+	if extErr != nil && (config.UpgradeWorld || len(config.UpgradeExtensions) > 0) {
+		ExitWithError(extErr, 1)
+	}
+	if skinErr != nil && (config.UpgradeWorld || len(config.UpgradeSkins) > 0) {
+		ExitWithError(skinErr, 1)
+	}
+	if _, err := resolveSelection(config); err != nil {
+		ExitWithError(err, 1)
+	}
+
+	if !config.UpgradeVendor && len(config.UpgradeExtensions) == 0 && len(config.UpgradeSkins) == 0 {
+		config.SyncConfig = true
+	}
+
+	type syncResult struct {
+		What    string   `json:"what"`
+		Src     string   `json:"src"`
+		Dst     string   `json:"dst"`
+		Changes []string `json:"changes"`
+		Error   string   `json:"error,omitempty"`
+	}
+
+	// the key has to get to ssh the same way it does in a deploy, or this tests something else
+	agent, err := setupDeployKey(config)
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	var results []syncResult
+	failed := false
+	baseArgs := remoteRsyncArgs(server, config)
+
+	for _, sync := range remoteSyncs(server, config) {
+		result := syncResult{What: sync.What, Src: sync.Src, Dst: sync.Dst, Changes: []string{}}
+
+		changes, err := rsyncItemize(nil, baseArgs, sync.Src, sync.Dst)
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		} else if changes != "" {
+			result.Changes = strings.Split(changes, "\n")
+		}
+
+		results = append(results, result)
+	}
+	agent.stop()
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"server": server, "syncs": results})
+	} else {
+		for _, result := range results {
+			switch {
+			case result.Error != "":
+				fmt.Printf("%s: FAILED: %s\n", result.What, result.Error)
+			case len(result.Changes) == 0:
+				fmt.Printf("%s: in sync\n", result.What)
+			default:
+				fmt.Printf("%s: %d changes\n", result.What, len(result.Changes))
+				for _, change := range result.Changes {
+					fmt.Printf("  %s\n", change)
+				}
+			}
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -1,7 +1,823 @@
 package internal
 
-import "fmt"
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+)
 
+// run one of the utility subcommands
 func RunUtil(args []string) {
-	fmt.Println("NOT IMPLEMENTED...WOULD RUN UTIL")
+	if len(args) < 1 {
+		ExitWithError(fmt.Errorf("incorrect number of arguments passed, expected a utils subcommand"), 1)
+	}
+
+	subcommand := args[0]
+
+	switch subcommand {
+	case "prune-stale-branches":
+		runPruneStaleBranches(args[1:])
+	case "which-server":
+		runWhichServer()
+	case "disk-usage":
+		runDiskUsage(args[1:])
+	case "verify-parity":
+		runVerifyParity(args[1:])
+	case "gc-repos":
+		runGCRepos(args[1:])
+	case "doctor":
+		runDoctor(args[1:])
+	case "rollback":
+		runRollback(args[1:])
+	case "extension-deps":
+		runExtensionDeps()
+	case "tail-deploy-log":
+		runTailDeployLog(args[1:])
+	case "test-rsync":
+		runTestRsync(args[1:])
+	case "clean-orphaned-prod-dirs":
+		runCleanOrphanedProdDirs(args[1:])
+	case "validate-extension-json":
+		runValidateExtensionJSON(args[1:])
+	case "fetch-all":
+		runFetchAll(args[1:])
+	case "show-config":
+		runShowConfig(args[1:])
+	case "last-deploy":
+		runLastDeploy(args[1:])
+	case "verify-key-permissions":
+		runVerifyKeyPermissions(args[1:])
+	case "deploy-what-if":
+		runDeployWhatIf(args[1:])
+	case "switch-release":
+		runSwitchRelease(args[1:])
+	case "list-pending":
+		runListPending(args[1:])
+	default:
+		ExitWithError(fmt.Errorf("unknown utils subcommand: %s", subcommand), 1)
+	}
+}
+
+// a repo we can run a utility against, e.g. extensions/VisualEditor
+type repo struct {
+	Name string
+	Path string
+	// the bare name of the extension or skin and whether it is an extension or skin
+	Short  string
+	IsSkin bool
+}
+
+// get every valid extension and skin as a list of repos; a path which doesn't exist just has no repos,
+// so e.g. a wiki farm without any skins of its own can still use the utilities
+func getAllRepos() ([]repo, error) {
+	var repos []repo
+
+	extensions, err := GetValidExtensions()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err != nil {
+		logf("No extensions at %s, skipping them\n", EXTENSIONPATH)
+	}
+	for _, ext := range extensions {
+		repos = append(repos, repo{Name: "extensions/" + ext, Path: fmt.Sprintf("%s/%s", EXTENSIONPATH, ext), Short: ext})
+	}
+
+	skins, err := GetValidSkins()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err != nil {
+		logf("No skins at %s, skipping them\n", SKINPATH)
+	}
+	for _, skin := range skins {
+		repos = append(repos, repo{Name: "skins/" + skin, Path: fmt.Sprintf("%s/%s", SKINPATH, skin), Short: skin, IsSkin: true})
+	}
+
+	return repos, nil
+}
+
+// where a repo is deployed to in production
+func (r repo) prodPath(prodExtensionsDir string, prodSkinsDir string) string {
+	if r.IsSkin {
+		return fmt.Sprintf("%s/%s/%s", PRODUCTIONPATH, prodSkinsDir, r.Short)
+	}
+	return fmt.Sprintf("%s/%s/%s", PRODUCTIONPATH, prodExtensionsDir, r.Short)
+}
+
+// print the normalized hostname of this server and whether it's one we know about
+func runWhichServer() {
+	hname, err := getShortHostname()
+	if err != nil {
+		ExitWithError(fmt.Errorf("could not determine hostname: %w", err), 1)
+	}
+
+	recognized := contains(ALLSERVERS, hname)
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"hostname": hname, "recognized": recognized})
+		return
+	}
+
+	fmt.Println(hname)
+
+	if recognized {
+		fmt.Println("recognized: yes")
+	} else {
+		fmt.Println("recognized: no")
+	}
+}
+
+// delete local branches which are already merged and whose upstream is gone (or which never had one)
+func runPruneStaleBranches(args []string) {
+	pruneCmd := flag.NewFlagSet("prune-stale-branches", flag.ExitOnError)
+	confirm := pruneCmd.Bool("confirm", false, "Actually delete the stale branches instead of only listing them")
+	pruneCmd.Parse(args)
+
+	type pruneResult struct {
+		Repo     string   `json:"repo"`
+		Branches []string `json:"branches"`
+		Removed  bool     `json:"removed"`
+		Error    string   `json:"error,omitempty"`
+	}
+
+	var results []pruneResult
+	failed := false
+
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	for _, r := range repos {
+		removed, err := pruneStaleBranches(r.Path, *confirm)
+		result := pruneResult{Repo: r.Name, Branches: removed, Removed: *confirm}
+		if err != nil {
+			result.Error = err.Error()
+			failed = true
+		}
+		results = append(results, result)
+
+		if JSONOUTPUT {
+			continue
+		}
+
+		if err != nil {
+			fmt.Printf("%s: %v\n", r.Name, err)
+			continue
+		}
+
+		for _, branch := range removed {
+			if *confirm {
+				fmt.Printf("%s: removed branch %s\n", r.Name, branch)
+			} else {
+				fmt.Printf("%s: would remove branch %s\n", r.Name, branch)
+			}
+		}
+	}
+
+	if JSONOUTPUT {
+		printJSON(results)
+	} else if !*confirm {
+		fmt.Println("Nothing was deleted, re-run with --confirm to remove the branches listed above")
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// prune the remote tracking branches of a repo and find (and optionally delete) its stale local branches
+func pruneStaleBranches(repoPath string, confirm bool) ([]string, error) {
+	if err := runCommand("git", "-C", repoPath, "fetch", "--prune", "--quiet"); err != nil {
+		return nil, fmt.Errorf("failed to fetch: %w", err)
+	}
+
+	// a shallow clone is missing the history needed to tell whether a branch is merged
+	shallow, err := isShallowRepo(repoPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check for a shallow clone: %w", err)
+	}
+	if shallow {
+		return nil, fmt.Errorf("shallow clone, skipping since merged branches can't be detected reliably")
+	}
+
+	// this fails on a detached HEAD, in which case there is no current branch to protect
+	current, _ := gitOutput(repoPath, "symbolic-ref", "--short", "-q", "HEAD")
+
+	merged, err := gitOutput(repoPath, "for-each-ref", "--merged", "HEAD", "--format=%(refname:short) %(upstream:short) %(upstream:track)", "refs/heads/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list merged branches: %w", err)
+	}
+
+	var stale []string
+	for _, line := range strings.Split(merged, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == current {
+			continue
+		}
+
+		// a branch still tracking an upstream that exists is not stale, even if it's merged
+		if len(fields) > 1 && !strings.Contains(line, "[gone]") {
+			continue
+		}
+
+		stale = append(stale, fields[0])
+	}
+
+	if !confirm {
+		return stale, nil
+	}
+
+	var removed []string
+	for _, branch := range stale {
+		if err := runCommand("git", "-C", repoPath, "branch", "-d", "--quiet", branch); err != nil {
+			return removed, fmt.Errorf("failed to delete branch %s: %w", branch, err)
+		}
+		removed = append(removed, branch)
+	}
+
+	return removed, nil
+}
+
+// report how much space each extension and skin takes up, biggest first
+func runDiskUsage(args []string) {
+	duCmd := flag.NewFlagSet("disk-usage", flag.ExitOnError)
+	asJSON := duCmd.Bool("json", false, "Output as JSON")
+	exclude := duCmd.String("exclude", "", "Comma separated directory names to leave out of the sizes (e.g. .git,tests,cache)")
+	duCmd.Parse(args)
+
+	var excluded []string
+	if *exclude != "" {
+		excluded = strings.Split(*exclude, ",")
+	}
+
+	type usage struct {
+		Name  string `json:"name"`
+		Bytes int64  `json:"bytes"`
+	}
+
+	var usages []usage
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	for _, r := range repos {
+		size, err := dirSize(r.Path, excluded)
+		if err != nil {
+			ExitWithError(fmt.Errorf("failed to get size of %s: %w", r.Name, err), 1)
+		}
+		usages = append(usages, usage{Name: r.Name, Bytes: size})
+	}
+
+	sort.Slice(usages, func(i, j int) bool {
+		return usages[i].Bytes > usages[j].Bytes
+	})
+
+	if *asJSON || JSONOUTPUT {
+		printJSON(usages)
+		return
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, u := range usages {
+		fmt.Fprintf(w, "%s\t%s\n", formatBytes(u.Bytes), u.Name)
+	}
+	w.Flush()
+}
+
+// get the total size of all files under a directory, skipping any directories with an excluded name
+func dirSize(path string, excluded []string) (int64, error) {
+	var size int64
+
+	err := filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p != path && contains(excluded, d.Name()) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		size += info.Size()
+		return nil
+	})
+
+	return size, err
+}
+
+// format a number of bytes for humans, e.g. 1.5M
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f%c", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// parse a number of bytes written for humans, e.g. 500M or 2G, the opposite of formatBytes
+func parseBytes(value string) (int64, error) {
+	number := strings.ToUpper(strings.TrimSuffix(strings.TrimSpace(value), "B"))
+
+	multiplier := int64(1)
+	if number != "" {
+		if i := strings.IndexByte("KMGTPE", number[len(number)-1]); i >= 0 {
+			for range i + 1 {
+				multiplier *= 1024
+			}
+			number = number[:len(number)-1]
+		}
+	}
+
+	n, err := strconv.ParseFloat(number, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected something like 500M", value)
+	}
+
+	return int64(n * float64(multiplier)), nil
+}
+
+// find extension and skin directories in production which have nothing in staging to deploy them from any
+// more; rsync --delete only works within each one, so removing one from staging leaves it in production
+func runCleanOrphanedProdDirs(args []string) {
+	cleanCmd := flag.NewFlagSet("clean-orphaned-prod-dirs", flag.ExitOnError)
+	confirm := cleanCmd.Bool("confirm", false, "Actually remove the orphaned directories instead of only listing them")
+	prodExtensionsDir := cleanCmd.String("prod-extensions-dir", DEFAULTPRODEXTENSIONSDIR, "Directory (relative to the production path) extensions are deployed to")
+	prodSkinsDir := cleanCmd.String("prod-skins-dir", DEFAULTPRODSKINSDIR, "Directory (relative to the production path) skins are deployed to")
+	cleanCmd.Parse(args)
+
+	type orphan struct {
+		Path    string `json:"path"`
+		Removed bool   `json:"removed"`
+		Error   string `json:"error,omitempty"`
+	}
+
+	dirs := []struct{ prod, staging string }{
+		{fmt.Sprintf("%s/%s", PRODUCTIONPATH, *prodExtensionsDir), EXTENSIONPATH},
+		{fmt.Sprintf("%s/%s", PRODUCTIONPATH, *prodSkinsDir), SKINPATH},
+	}
+
+	orphans := []orphan{}
+	failed := false
+
+	for _, dir := range dirs {
+		// an empty or missing staging directory (e.g. a wrong path) would make everything in production
+		// look orphaned
+		staging, err := os.ReadDir(dir.staging)
+		if err != nil {
+			ExitWithError(fmt.Errorf("failed to read %s, refusing to look for orphans without it: %w", dir.staging, err), 1)
+		}
+		if len(staging) == 0 {
+			ExitWithError(fmt.Errorf("%s is empty, refusing to treat everything in %s as orphaned - is the path correct?", dir.staging, dir.prod), 1)
+		}
+
+		entries, err := os.ReadDir(dir.prod)
+		if err != nil {
+			ExitWithError(err, 1)
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+				continue
+			}
+
+			// only something which is definitely not in staging is orphaned, anything else that stops it
+			// being checked is a reason to stop rather than remove it
+			_, err := os.Stat(fmt.Sprintf("%s/%s", dir.staging, entry.Name()))
+			if err == nil {
+				continue
+			}
+			if !errors.Is(err, os.ErrNotExist) {
+				ExitWithError(fmt.Errorf("failed to check %s is still in staging: %w", entry.Name(), err), 1)
+			}
+
+			orphans = append(orphans, orphan{Path: fmt.Sprintf("%s/%s", dir.prod, entry.Name())})
+		}
+	}
+
+	// everything is checked before anything is removed, so stopping above never leaves it half done
+	if *confirm {
+		for i := range orphans {
+			if err := os.RemoveAll(orphans[i].Path); err != nil {
+				orphans[i].Error = err.Error()
+				failed = true
+			} else {
+				orphans[i].Removed = true
+			}
+		}
+	}
+
+	if JSONOUTPUT {
+		printJSON(orphans)
+	} else {
+		for _, o := range orphans {
+			switch {
+			case o.Error != "":
+				fmt.Printf("%s: failed to remove: %s\n", o.Path, o.Error)
+			case o.Removed:
+				fmt.Printf("%s: removed\n", o.Path)
+			default:
+				fmt.Printf("%s: would remove\n", o.Path)
+			}
+		}
+
+		if len(orphans) == 0 {
+			fmt.Println("No orphaned directories in production")
+		} else if !*confirm {
+			fmt.Println("Nothing was removed, re-run with --confirm to remove the directories listed above")
+		}
+	}
+
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// check that what is deployed to production is what is checked out in staging, using the deployed marker
+// written into each extension and skin during a deploy
+func runVerifyParity(args []string) {
+	parityCmd := flag.NewFlagSet("verify-parity", flag.ExitOnError)
+	prodExtensionsDir := parityCmd.String("prod-extensions-dir", DEFAULTPRODEXTENSIONSDIR, "Directory (relative to the production path) extensions are deployed to")
+	prodSkinsDir := parityCmd.String("prod-skins-dir", DEFAULTPRODSKINSDIR, "Directory (relative to the production path) skins are deployed to")
+	parityCmd.Parse(args)
+
+	type parityResult struct {
+		Repo          string `json:"repo"`
+		StagingSHA    string `json:"staging_sha"`
+		ProductionSHA string `json:"production_sha"`
+		DeployedAt    string `json:"deployed_at,omitempty"`
+		OK            bool   `json:"ok"`
+		Error         string `json:"error,omitempty"`
+	}
+
+	var results []parityResult
+	mismatched := 0
+
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	for _, r := range repos {
+		prodPath := r.prodPath(*prodExtensionsDir, *prodSkinsDir)
+
+		// not everything in staging is deployed, and that's fine
+		if _, err := os.Stat(prodPath); err != nil {
+			continue
+		}
+
+		result := parityResult{Repo: r.Name}
+		stagingSHA, err := gitOutput(r.Path, "rev-parse", "HEAD")
+		if err != nil {
+			result.Error = fmt.Sprintf("could not get staging HEAD: %v", err)
+		} else if marker, err := readDeployedMarker(prodPath); err != nil {
+			result.StagingSHA = stagingSHA
+			result.Error = fmt.Sprintf("could not read deployed marker: %v", err)
+		} else {
+			result.StagingSHA, result.ProductionSHA, result.DeployedAt = stagingSHA, marker.SHA, marker.DeployedAt
+			result.OK = marker.SHA == stagingSHA
+		}
+
+		if !result.OK {
+			mismatched++
+		}
+		results = append(results, result)
+	}
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"pass": mismatched == 0, "results": results})
+	} else {
+		for _, result := range results {
+			switch {
+			case result.Error != "":
+				fmt.Printf("FAIL %s: %s\n", result.Repo, result.Error)
+			case !result.OK:
+				fmt.Printf("FAIL %s: staging is at %s but production has %s (deployed %s)\n", result.Repo, result.StagingSHA, result.ProductionSHA, result.DeployedAt)
+			}
+		}
+
+		if mismatched > 0 {
+			fmt.Printf("FAIL: %d of %d deployed extensions and skins don't match staging\n", mismatched, len(results))
+		} else {
+			fmt.Printf("PASS: all %d deployed extensions and skins match staging\n", len(results))
+		}
+	}
+
+	if mismatched > 0 {
+		os.Exit(1)
+	}
+}
+
+// fetch every extension and skin, a few at a time, without changing any working tree, and report how many
+// commits each is now behind its upstream by; run ahead of a deploy, this makes the deploy faster and shows
+// up auth problems before they can stop it
+func runFetchAll(args []string) {
+	fetchCmd := flag.NewFlagSet("fetch-all", flag.ExitOnError)
+	maxParallel := fetchCmd.Int("max-parallel", 4, "Maximum number of repos to fetch at once")
+	fetchCmd.Parse(args)
+
+	type fetchResult struct {
+		Repo    string `json:"repo"`
+		Pending int    `json:"pending"`
+		// a detached HEAD, e.g. after a deploy from a lock, has nothing to be pending against
+		NoUpstream bool   `json:"no_upstream,omitempty"`
+		Error      string `json:"error,omitempty"`
+	}
+
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+	results := make([]fetchResult, len(repos))
+	sem := make(chan struct{}, max(*maxParallel, 1))
+	var wg sync.WaitGroup
+
+	for i, r := range repos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = fetchResult{Repo: r.Name}
+			if err := fetchRepo(r.Path); err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+
+			// the branch header has an "# branch.ab +<ahead> -<behind>" line only if there is an upstream
+			status, err := gitOutput(r.Path, "status", "--porcelain=v2", "--branch", "--untracked-files=no")
+			if err != nil {
+				results[i].Error = err.Error()
+				return
+			}
+
+			results[i].NoUpstream = true
+			for _, line := range strings.Split(status, "\n") {
+				if ab, ok := strings.CutPrefix(line, "# branch.ab "); ok {
+					_, behind, _ := strings.Cut(ab, " -")
+					results[i].Pending, _ = strconv.Atoi(behind)
+					results[i].NoUpstream = false
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	failed := 0
+	w := tabwriter.NewWriter(progressOutput(), 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		switch {
+		case result.Error != "":
+			fmt.Fprintf(w, "%s\tFAILED: %s\n", result.Repo, result.Error)
+			failed++
+		case result.NoUpstream:
+			fmt.Fprintf(w, "%s\tno upstream branch\n", result.Repo)
+		case result.Pending == 0:
+			fmt.Fprintf(w, "%s\tup to date\n", result.Repo)
+		default:
+			fmt.Fprintf(w, "%s\t%d pending\n", result.Repo, result.Pending)
+		}
+	}
+	w.Flush()
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"failed": failed, "repos": results})
+	} else if failed > 0 {
+		fmt.Printf("Failed to fetch %d of %d repos\n", failed, len(results))
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// fetch a repo from its remote, keeping what git says when it fails, since that's where e.g. an auth
+// problem is explained
+func fetchRepo(repoPath string) error {
+	cmd, ctx, cancel := newCommand("git", "-C", repoPath, "fetch", "--quiet", "--prune")
+	defer cancel()
+	traceCommand(nil, "", "git", cmd.Args[1:])
+
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := checkTimeout(ctx, cmd, cmd.Run()); err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
+
+// show, for every deployed extension and skin, the commits on its upstream which production doesn't have
+// yet according to its deployed marker, fetching first so upstream is current
+func runListPending(args []string) {
+	pendingCmd := flag.NewFlagSet("list-pending", flag.ExitOnError)
+	prodExtensionsDir := pendingCmd.String("prod-extensions-dir", DEFAULTPRODEXTENSIONSDIR, "Directory (relative to the production path) extensions are deployed to")
+	prodSkinsDir := pendingCmd.String("prod-skins-dir", DEFAULTPRODSKINSDIR, "Directory (relative to the production path) skins are deployed to")
+	noFetch := pendingCmd.Bool("no-fetch", false, "Use upstream as of the last fetch instead of fetching every repo first")
+	maxParallel := pendingCmd.Int("max-parallel", 4, "Maximum number of repos to fetch at once")
+	pendingCmd.Parse(args)
+
+	type pendingResult struct {
+		Repo        string   `json:"repo"`
+		DeployedSHA string   `json:"deployed_sha,omitempty"`
+		Pending     int      `json:"pending"`
+		Commits     []string `json:"commits,omitempty"`
+		NoUpstream  bool     `json:"no_upstream,omitempty"`
+		Error       string   `json:"error,omitempty"`
+	}
+
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+
+	// not everything in staging is deployed, and that's fine
+	var deployed []repo
+	for _, r := range repos {
+		if _, err := os.Stat(r.prodPath(*prodExtensionsDir, *prodSkinsDir)); err == nil {
+			deployed = append(deployed, r)
+		}
+	}
+
+	results := make([]pendingResult, len(deployed))
+	sem := make(chan struct{}, max(*maxParallel, 1))
+	var wg sync.WaitGroup
+
+	for i, r := range deployed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			results[i] = pendingResult{Repo: r.Name}
+			if !*noFetch {
+				if err := fetchRepo(r.Path); err != nil {
+					results[i].Error = fmt.Sprintf("failed to fetch: %v", err)
+					return
+				}
+			}
+
+			marker, err := readDeployedMarker(r.prodPath(*prodExtensionsDir, *prodSkinsDir))
+			if err != nil {
+				results[i].Error = fmt.Sprintf("could not read deployed marker: %v", err)
+				return
+			}
+			results[i].DeployedSHA = marker.SHA
+			if strings.HasPrefix(marker.SHA, "sha256:") {
+				results[i].Error = "deployed from an artifact, there's no git history to compare"
+				return
+			}
+
+			// a detached HEAD, e.g. after a deploy from a lock, has no upstream to have anything pending
+			if _, err := gitOutput(r.Path, "rev-parse", "--verify", "--quiet", "@{upstream}"); err != nil {
+				results[i].NoUpstream = true
+				return
+			}
+
+			commits, err := gitOutput(r.Path, "log", "--format=%h %s", marker.SHA+"..@{upstream}")
+			if err != nil {
+				results[i].Error = fmt.Sprintf("failed to compare deployed %s with upstream: %v", marker.SHA, err)
+				return
+			}
+			if commits != "" {
+				results[i].Commits = strings.Split(commits, "\n")
+				results[i].Pending = len(results[i].Commits)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	failed, waiting := 0, 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+		}
+		if result.Pending > 0 {
+			waiting++
+		}
+	}
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"waiting": waiting, "failed": failed, "repos": results})
+	} else {
+		for _, result := range results {
+			switch {
+			case result.Error != "":
+				fmt.Printf("%s: FAILED: %s\n", result.Repo, result.Error)
+			case result.NoUpstream:
+				fmt.Printf("%s: no upstream branch\n", result.Repo)
+			case result.Pending > 0:
+				fmt.Printf("%s: %d pending\n", result.Repo, result.Pending)
+				for _, commit := range result.Commits {
+					fmt.Printf("  %s\n", commit)
+				}
+			}
+		}
+
+		fmt.Printf("%d of %d deployed extensions and skins have commits waiting to be deployed\n", waiting, len(results))
+	}
+
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// run git gc across every extension and skin, a few at a time, and report how much space was reclaimed
+func runGCRepos(args []string) {
+	gcCmd := flag.NewFlagSet("gc-repos", flag.ExitOnError)
+	aggressive := gcCmd.Bool("aggressive", false, "Run git gc --aggressive instead of --auto (much slower)")
+	maxParallel := gcCmd.Int("max-parallel", 4, "Maximum number of repos to gc at once")
+	gcCmd.Parse(args)
+
+	gcArgs := []string{"gc", "--quiet", "--auto"}
+	if *aggressive {
+		gcArgs = []string{"gc", "--quiet", "--aggressive"}
+	}
+
+	type gcResult struct {
+		Repo      string `json:"repo"`
+		Reclaimed int64  `json:"reclaimed_bytes"`
+		Error     string `json:"error,omitempty"`
+	}
+
+	repos, err := getAllRepos()
+	if err != nil {
+		ExitWithError(err, 1)
+	}
+	results := make([]gcResult, len(repos))
+	sem := make(chan struct{}, max(*maxParallel, 1))
+	var wg sync.WaitGroup
+
+	for i, r := range repos {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			gitDir := r.Path + "/.git"
+			before, _ := dirSize(gitDir, nil)
+			_, err := gitOutput(r.Path, gcArgs...)
+			after, _ := dirSize(gitDir, nil)
+
+			results[i] = gcResult{Repo: r.Name, Reclaimed: before - after}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	var total int64
+	failed := false
+	w := tabwriter.NewWriter(progressOutput(), 0, 0, 2, ' ', 0)
+	for _, result := range results {
+		if result.Error != "" {
+			fmt.Fprintf(w, "%s\tFAILED: %s\n", result.Repo, result.Error)
+			failed = true
+			continue
+		}
+		total += result.Reclaimed
+		fmt.Fprintf(w, "%s\t%s reclaimed\n", result.Repo, formatBytes(result.Reclaimed))
+	}
+	w.Flush()
+
+	if JSONOUTPUT {
+		printJSON(map[string]any{"total_reclaimed_bytes": total, "repos": results})
+	} else {
+		fmt.Printf("Total reclaimed: %s\n", formatBytes(total))
+	}
+
+	if failed {
+		os.Exit(1)
+	}
 }
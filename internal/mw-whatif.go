@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+)
+
+// everything a deploy with the given flags would do, as worked out before it starts
+type deployPlan struct {
+	Servers     []string    `json:"servers"`
+	Local       bool        `json:"local"`
+	Canary      string      `json:"canary,omitempty"`
+	MaxParallel int         `json:"max_parallel"`
+	PushOnly    string      `json:"push_only,omitempty"`
+	Vendor      bool        `json:"vendor"`
+	Config      bool        `json:"config"`
+	Extensions  []string    `json:"extensions"`
+	Skins       []string    `json:"skins"`
+	L10n        bool        `json:"l10n"`
+	Lang        string      `json:"lang,omitempty"`
+	Selections  []selection `json:"selections"`
+}
+
+// print what a deploy with the same flags would do, without the deploy host check or changing anything,
+// so anyone reviewing a deploy can see exactly what it will touch and in what order
+func runDeployWhatIf(args []string) {
+	hname, err := getShortHostname()
+	if err != nil {
+		ExitWithError(fmt.Errorf("could not determine hostname: %w", err), 1)
+	}
+	HOSTNAME = hname
+
+	config, err := parseFlags(args)
+	if err != nil {
+		ExitWithError(err, EXITCONFIG)
+	}
+	COMMANDTIMEOUTS["git"] = config.GitTimeout
+
+	selections, err := planDeploy(config)
+	if err != nil {
+		ExitWithError(err, exitCodeOf(err))
+	}
+
+	plan := deployPlan{
+		Servers:     []string{},
+		Canary:      config.Canary,
+		MaxParallel: max(config.MaxParallel, 1),
+		PushOnly:    config.PushOnly,
+		Vendor:      config.UpgradeVendor,
+		Config:      config.SyncConfig,
+		Extensions:  append([]string{}, config.UpgradeExtensions...),
+		Skins:       append([]string{}, config.UpgradeSkins...),
+		L10n:        config.L10n,
+		Lang:        config.Lang,
+		Selections:  selections,
+	}
+	for _, server := range config.Servers {
+		if server == HOSTNAME {
+			plan.Local = true
+			continue
+		}
+		plan.Servers = append(plan.Servers, server)
+	}
+
+	if JSONOUTPUT {
+		printJSON(plan)
+	} else {
+		printDeployPlan(plan)
+		if config.Explain {
+			printSelection(selections)
+		}
+	}
+
+	if config.CompareRef != "" {
+		printDeployedComparison(config)
+	}
+}
+
+// print a plan the way an operator reads a deploy: where it goes, then what goes
+func printDeployPlan(plan deployPlan) {
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	list := func(names []string) string {
+		if len(names) == 0 {
+			return "none"
+		}
+		return strings.Join(names, ", ")
+	}
+
+	fmt.Printf("Deploy plan from %s, nothing has been changed:\n", HOSTNAME)
+	if plan.PushOnly != "" {
+		fmt.Printf("  Push only: the production tree as it is to %s\n", plan.PushOnly)
+	} else {
+		fmt.Printf("  Local work on %s: %s\n", HOSTNAME, yesNo(plan.Local))
+	}
+	fmt.Printf("  Remote servers: %s\n", list(plan.Servers))
+	if plan.Canary != "" {
+		fmt.Printf("  Canary: %s first, then the rest %d at a time\n", plan.Canary, plan.MaxParallel)
+	} else if len(plan.Servers) > 0 {
+		fmt.Printf("  Synced %d at a time\n", plan.MaxParallel)
+	}
+	fmt.Printf("  Vendor: %s\n", yesNo(plan.Vendor))
+	fmt.Printf("  Config: %s\n", yesNo(plan.Config))
+	fmt.Printf("  Extensions, in deploy order: %s\n", list(plan.Extensions))
+	fmt.Printf("  Skins: %s\n", list(plan.Skins))
+	if plan.L10n && plan.Lang != "" {
+		fmt.Printf("  L10n: yes (%s)\n", plan.Lang)
+	} else {
+		fmt.Printf("  L10n: %s\n", yesNo(plan.L10n))
+	}
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// where a repo's files are deployed from: its --worktree checkout if it has one, otherwise the repo itself
+func (c *DeployConfig) sourcePath(repoPath string) string {
+	if worktree, ok := c.worktrees[repoPath]; ok {
+		return worktree
+	}
+	return repoPath
+}
+
+// check a repo out for --worktree into a worktree of its own, at the commit the deploy is for (its upstream
+// after a fetch, or the locked commit), leaving the staging checkout and whatever anyone is doing in it alone
+func checkoutWorktree(repoPath string, kind string, config *DeployConfig) error {
+	name := filepath.Base(repoPath)
+
+	target := "@{upstream}"
+	if config.Lock != nil {
+		target = lockedSHA(config.Lock, name, kind == "skins")
+	}
+
+	// only a clone which is already shallow is kept shallow, a depth limited fetch would make a full one
+	// shallow for good
+	fetchArgs := []string{"-C", repoPath, "fetch", "--quiet", "origin"}
+	if config.Shallow && config.Lock == nil {
+		if shallow, err := isShallowRepo(repoPath); err == nil && shallow {
+			fetchArgs = append(fetchArgs, "--depth=1")
+		}
+	}
+	if err := runCommand("git", fetchArgs...); err != nil {
+		return fmt.Errorf("failed to fetch %s: %w", repoPath, err)
+	}
+
+	// a dry run didn't fetch, so this is as of the last fetch, which is as close as it can get
+	sha, err := gitOutput(repoPath, "rev-parse", "--verify", "--quiet", target+"^{commit}")
+	if err != nil || sha == "" {
+		return fmt.Errorf("can't find %s in %s to check out: %v", target, repoPath, err)
+	}
+
+	// what the checkout is at is the closest thing to what was deployed before, for lint and --l10n-scope
+	before, err := gitOutput(repoPath, "rev-parse", "HEAD")
+	if err != nil {
+		return fmt.Errorf("failed to get HEAD of %s: %w", repoPath, err)
+	}
+
+	if DRYRUN {
+		logf("Would deploy %s at %s from a worktree, rsync shows what the staging checkout would change instead\n", repoPath, sha)
+		return nil
+	}
+
+	if config.worktreeDir == "" {
+		if config.worktreeDir, err = os.MkdirTemp("", "mw-deploy-worktrees-"); err != nil {
+			return fmt.Errorf("failed to create a directory for worktrees: %w", err)
+		}
+	}
+
+	worktree := filepath.Join(config.worktreeDir, kind, name)
+	if err := runCommand("git", "-C", repoPath, "worktree", "add", "--quiet", "--detach", worktree, sha); err != nil {
+		return fmt.Errorf("failed to add a worktree of %s at %s: %w", repoPath, sha, err)
+	}
+	if config.worktrees == nil {
+		config.worktrees = map[string]string{}
+	}
+	config.worktrees[repoPath] = worktree
+
+	// pulls of extensions recurse into submodules, so this has to as well
+	if kind == "extensions" {
+		if err := runCommand("git", "-C", worktree, "submodule", "update", "--init", "--recursive", "--quiet"); err != nil {
+			return fmt.Errorf("failed to check out the submodules of %s: %w", repoPath, err)
+		}
+	}
+
+	if config.Lint {
+		if err := lintPulled(worktree, before); err != nil {
+			return err
+		}
+	}
+
+	config.pullFrom(repoPath, before)
+	return nil
+}
+
+// remove every worktree --worktree made, once everything has been synced from them; one which can't be
+// removed is only reported, since the deploy itself has already happened
+func removeWorktrees(config *DeployConfig) {
+	if config.worktreeDir == "" {
+		return
+	}
+
+	var failed []string
+	for repoPath, worktree := range config.worktrees {
+		if err := runCommand("git", "-C", repoPath, "worktree", "remove", "--force", worktree); err != nil {
+			failed = append(failed, repoPath)
+		}
+	}
+
+	if err := os.RemoveAll(config.worktreeDir); err != nil {
+		logf("Failed to remove %s: %v\n", config.worktreeDir, err)
+	}
+	if len(failed) > 0 {
+		logf("Failed to remove the worktrees of %s, run git worktree prune in them\n", strings.Join(failed, ", "))
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"os"
 
@@ -8,20 +9,30 @@ import (
 )
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("incorrect number of arguments passed, expected 'deploy' or 'utils' subcommand")
-		os.Exit(1)
+	// global flags come before the subcommand, e.g. mediawiki-utils --json utils disk-usage
+	globalCmd := flag.NewFlagSet("mediawiki-utils", flag.ExitOnError)
+	jsonOutput := globalCmd.Bool("json", false, "Output JSON (progress goes to stderr)")
+	globalCmd.Parse(os.Args[1:])
+
+	internal.JSONOUTPUT = *jsonOutput
+	args := globalCmd.Args()
+
+	if len(args) < 1 {
+		internal.ExitWithError(fmt.Errorf("incorrect number of arguments passed, expected 'deploy' or 'utils' subcommand"), internal.EXITCONFIG)
+	}
+
+	if err := internal.LoadSettings(); err != nil {
+		internal.ExitWithError(err, internal.EXITCONFIG)
 	}
 
-	subcommand := os.Args[1]
+	subcommand := args[0]
 
 	switch subcommand {
 	case "deploy":
-		internal.RunDeploy(os.Args[2:])
+		internal.RunDeploy(args[1:])
 	case "utils":
-		internal.RunUtil(os.Args[2:])
+		internal.RunUtil(args[1:])
 	default:
-		fmt.Println("unknown subcommand:", subcommand)
-		os.Exit(1)
+		internal.ExitWithError(fmt.Errorf("unknown subcommand: %s", subcommand), internal.EXITCONFIG)
 	}
 }